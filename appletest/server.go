@@ -0,0 +1,385 @@
+// Package appletest provides a fake Apple ID server for testing code built
+// on the apple package without reaching Apple.
+package appletest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	apple "github.com/meszmate/apple-go"
+)
+
+// Paths of the endpoints served by Server.
+const (
+	TokenEndpoint  = "/auth/token"
+	RevokeEndpoint = "/auth/revoke"
+	KeysEndpoint   = "/auth/keys"
+)
+
+const (
+	issuer          = "https://appleid.apple.com"
+	keyID           = "appletest"
+	tokenLifetime   = time.Hour
+	idTokenLifetime = 10 * time.Minute
+)
+
+// RefreshToken is a refresh token issued by Server.
+type RefreshToken struct {
+	Token    string
+	ClientID string
+	Subject  string
+	Revoked  bool
+}
+
+// authorization is a pending authorization code.
+type authorization struct {
+	subject string
+	claims  map[string]interface{}
+}
+
+// failure is an injected error response.
+type failure struct {
+	status    int
+	errorType apple.ErrorResponseType
+}
+
+// Server is a fake Apple ID server answering the token, revoke and keys
+// endpoints. Point clients at it with Options. Client secrets are checked
+// for their claims but not their signature.
+// A Server is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	key *rsa.PrivateKey
+
+	mu            sync.Mutex
+	codes         map[string]authorization
+	refreshTokens map[string]*RefreshToken
+	failures      map[string][]failure
+}
+
+// NewServer starts a Server. Call Close when done.
+func NewServer() *Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic("appletest: generate key: " + err.Error())
+	}
+
+	s := &Server{
+		key:           key,
+		codes:         make(map[string]authorization),
+		refreshTokens: make(map[string]*RefreshToken),
+		failures:      make(map[string][]failure),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(TokenEndpoint, s.handleToken)
+	mux.HandleFunc(RevokeEndpoint, s.handleRevoke)
+	mux.HandleFunc(KeysEndpoint, s.handleKeys)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Options returns the client options pointing a client at s.
+func (s *Server) Options() []apple.Option {
+	return []apple.Option{apple.WithBaseURL(s.URL), apple.WithHTTPClient(s.Client())}
+}
+
+// KeySet returns a KeySet reading the keys s signs ID tokens with.
+func (s *Server) KeySet() *apple.KeySet {
+	return apple.NewKeySet("", s.Options()...)
+}
+
+// NewAuth returns an AppleAuth for clientID talking to s, signing its
+// client secrets with a throwaway key.
+func (s *Server) NewAuth(clientID string, opts ...apple.Option) (apple.AppleAuth, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := apple.NewCryptoSigner("TESTKEY123", key)
+	if err != nil {
+		return nil, err
+	}
+	return apple.NewWithSigner(clientID, "TESTTEAM12", signer, append(s.Options(), opts...)...)
+}
+
+// IssueCode registers a single-use authorization code for subject. The ID
+// token returned for it carries claims on top of the standard ones, which
+// claims may also override, e.g. "email", "nonce" or "exp".
+func (s *Server) IssueCode(subject string, claims map[string]interface{}) string {
+	code := randomString()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[code] = authorization{subject: subject, claims: claims}
+	return code
+}
+
+// IDToken returns an ID token for clientID and subject as issued by the
+// token endpoint, with claims added on top of the standard ones.
+func (s *Server) IDToken(clientID, subject string, claims map[string]interface{}) string {
+	now := time.Now()
+	all := jwt.MapClaims{
+		"iss":            issuer,
+		"aud":            clientID,
+		"sub":            subject,
+		"iat":            now.Unix(),
+		"exp":            now.Add(idTokenLifetime).Unix(),
+		"auth_time":      now.Unix(),
+		"email_verified": "true",
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	return s.SignIDToken(all)
+}
+
+// SignIDToken signs claims as they are with the server key, e.g. to build
+// expired or otherwise invalid tokens.
+func (s *Server) SignIDToken(claims map[string]interface{}) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims(claims))
+	token.Header["kid"] = keyID
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		panic("appletest: sign id token: " + err.Error())
+	}
+	return signed
+}
+
+// RefreshTokens returns every refresh token issued so far.
+func (s *Server) RefreshTokens() []RefreshToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := make([]RefreshToken, 0, len(s.refreshTokens))
+	for _, t := range s.refreshTokens {
+		tokens = append(tokens, *t)
+	}
+	return tokens
+}
+
+// IsRevoked reports whether a refresh token was issued and then revoked.
+func (s *Server) IsRevoked(refreshToken string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.refreshTokens[refreshToken]
+	return ok && t.Revoked
+}
+
+// RevokeRefreshToken revokes a refresh token as if the user had stopped
+// using Sign in with Apple for the app.
+func (s *Server) RevokeRefreshToken(refreshToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.refreshTokens[refreshToken]; ok {
+		t.Revoked = true
+	}
+}
+
+// FailNext makes the next request to endpoint fail with a 400 response
+// carrying errorType. Calls queue up.
+func (s *Server) FailNext(endpoint string, errorType apple.ErrorResponseType) {
+	s.failNext(endpoint, failure{status: http.StatusBadRequest, errorType: errorType})
+}
+
+// FailNextStatus makes the next request to endpoint fail with status and
+// an empty body, e.g. to simulate an outage. Calls queue up.
+func (s *Server) FailNextStatus(endpoint string, status int) {
+	s.failNext(endpoint, failure{status: status})
+}
+
+func (s *Server) failNext(endpoint string, f failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[endpoint] = append(s.failures[endpoint], f)
+}
+
+// injectedFailure writes the next queued failure of the request's endpoint,
+// if any.
+func (s *Server) injectedFailure(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.Lock()
+	queue := s.failures[r.URL.Path]
+	if len(queue) == 0 {
+		s.mu.Unlock()
+		return false
+	}
+	f := queue[0]
+	s.failures[r.URL.Path] = queue[1:]
+	s.mu.Unlock()
+
+	if f.errorType == "" {
+		w.WriteHeader(f.status)
+		return true
+	}
+	writeJSON(w, f.status, map[string]string{"error": string(f.errorType)})
+	return true
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if s.injectedFailure(w, r) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, apple.ErrorResponseTypeInvalidRequest)
+		return
+	}
+
+	clientID := r.PostForm.Get("client_id")
+	if !validClientSecret(clientID, r.PostForm.Get("client_secret")) {
+		writeError(w, apple.ErrorResponseTypeInvalidClient)
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		s.exchangeCode(w, clientID, r.PostForm.Get("code"))
+	case "refresh_token":
+		s.refresh(w, clientID, r.PostForm.Get("refresh_token"))
+	case "client_credentials":
+		writeJSON(w, http.StatusOK, apple.TokenResponse{
+			AccessToken: randomString(),
+			ExpiresIn:   int(tokenLifetime / time.Second),
+			TokenType:   "Bearer",
+		})
+	case "":
+		writeError(w, apple.ErrorResponseTypeInvalidRequest)
+	default:
+		writeError(w, apple.ErrorResponseTypeUnsupportedGrantType)
+	}
+}
+
+func (s *Server) exchangeCode(w http.ResponseWriter, clientID, code string) {
+	s.mu.Lock()
+	auth, ok := s.codes[code]
+	delete(s.codes, code)
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, apple.ErrorResponseTypeInvalidGrant)
+		return
+	}
+
+	refreshToken := randomString()
+	s.mu.Lock()
+	s.refreshTokens[refreshToken] = &RefreshToken{Token: refreshToken, ClientID: clientID, Subject: auth.subject}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, apple.TokenResponse{
+		AccessToken:  randomString(),
+		ExpiresIn:    int(tokenLifetime / time.Second),
+		IDToken:      s.IDToken(clientID, auth.subject, auth.claims),
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+	})
+}
+
+func (s *Server) refresh(w http.ResponseWriter, clientID, refreshToken string) {
+	s.mu.Lock()
+	t, ok := s.refreshTokens[refreshToken]
+	valid := ok && !t.Revoked && t.ClientID == clientID
+	s.mu.Unlock()
+	if !valid {
+		writeError(w, apple.ErrorResponseTypeInvalidGrant)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apple.TokenResponse{
+		AccessToken: randomString(),
+		ExpiresIn:   int(tokenLifetime / time.Second),
+		IDToken:     s.IDToken(clientID, t.Subject, nil),
+		TokenType:   "Bearer",
+	})
+}
+
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if s.injectedFailure(w, r) {
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("token") == "" {
+		writeError(w, apple.ErrorResponseTypeInvalidRequest)
+		return
+	}
+	clientID := r.PostForm.Get("client_id")
+	if !validClientSecret(clientID, r.PostForm.Get("client_secret")) {
+		writeError(w, apple.ErrorResponseTypeInvalidClient)
+		return
+	}
+
+	// Like Apple, unknown tokens are accepted silently.
+	token := r.PostForm.Get("token")
+	s.mu.Lock()
+	if t, ok := s.refreshTokens[token]; ok && t.ClientID == clientID {
+		t.Revoked = true
+	}
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if s.injectedFailure(w, r) {
+		return
+	}
+	pub := s.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// validClientSecret checks the claims Apple requires in a client secret.
+func validClientSecret(clientID, secret string) bool {
+	if clientID == "" || secret == "" {
+		return false
+	}
+	var claims jwt.StandardClaims
+	token, _, err := new(jwt.Parser).ParseUnverified(secret, &claims)
+	if err != nil || token.Method.Alg() != "ES256" {
+		return false
+	}
+	return claims.Subject == clientID && claims.Audience == issuer &&
+		claims.Issuer != "" && claims.ExpiresAt > time.Now().Unix()
+}
+
+func writeError(w http.ResponseWriter, errorType apple.ErrorResponseType) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": string(errorType)})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic("appletest: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
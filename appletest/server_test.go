@@ -0,0 +1,138 @@
+package appletest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	apple "github.com/meszmate/apple-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerCodeExchange(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	auth, err := srv.NewAuth("com.example.app")
+	assert.NoError(t, err)
+
+	code := srv.IssueCode("001234.abcd", map[string]interface{}{"email": "jane@example.com", "nonce": "raw-nonce"})
+	token, err := auth.ValidateCode(code)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token.AccessToken)
+	assert.NotEmpty(t, token.RefreshToken)
+
+	user, err := apple.VerifyIDTokenWithOptions(srv.KeySet(), token.IDToken, apple.IDTokenOptions{
+		Audiences: []string{"com.example.app"},
+		Nonce:     "raw-nonce",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "001234.abcd", user.Subject)
+		assert.Equal(t, "jane@example.com", user.Email)
+		assert.True(t, user.EmailVerified)
+	}
+
+	// Codes are single use.
+	_, err = auth.ValidateCode(code)
+	assert.ErrorIs(t, err, apple.ErrorResponseInvalidGrant)
+}
+
+func TestServerRefreshAndRevoke(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	auth, err := srv.NewAuth("com.example.app")
+	assert.NoError(t, err)
+	token, err := auth.ValidateCode(srv.IssueCode("001234.abcd", nil))
+	assert.NoError(t, err)
+
+	refreshed, err := auth.ValidateRefreshToken(token.RefreshToken)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, refreshed.IDToken)
+	assert.Empty(t, refreshed.RefreshToken)
+
+	// Another client cannot use the token.
+	other, err := srv.NewAuth("com.example.other")
+	assert.NoError(t, err)
+	_, err = other.ValidateRefreshToken(token.RefreshToken)
+	assert.ErrorIs(t, err, apple.ErrorResponseInvalidGrant)
+
+	assert.NoError(t, auth.RevokeToken(token.RefreshToken, apple.TokenTypeHintRefreshToken))
+	assert.True(t, srv.IsRevoked(token.RefreshToken))
+	if tokens := srv.RefreshTokens(); assert.Len(t, tokens, 1) {
+		assert.Equal(t, RefreshToken{Token: token.RefreshToken, ClientID: "com.example.app", Subject: "001234.abcd", Revoked: true}, tokens[0])
+	}
+
+	_, err = auth.ValidateRefreshToken(token.RefreshToken)
+	assert.ErrorIs(t, err, apple.ErrorResponseInvalidGrant)
+}
+
+func TestServerRevokeRefreshToken(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	auth, err := srv.NewAuth("com.example.app")
+	assert.NoError(t, err)
+	token, err := auth.ValidateCode(srv.IssueCode("001234.abcd", nil))
+	assert.NoError(t, err)
+
+	srv.RevokeRefreshToken(token.RefreshToken)
+	_, err = auth.ValidateRefreshToken(token.RefreshToken)
+	assert.ErrorIs(t, err, apple.ErrorResponseInvalidGrant)
+}
+
+func TestServerFailNext(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	auth, err := srv.NewAuth("com.example.app")
+	assert.NoError(t, err)
+	code := srv.IssueCode("001234.abcd", nil)
+
+	srv.FailNext(TokenEndpoint, apple.ErrorResponseTypeInvalidClient)
+	srv.FailNextStatus(TokenEndpoint, http.StatusServiceUnavailable)
+
+	_, err = auth.ValidateCode(code)
+	assert.ErrorIs(t, err, apple.ErrorResponseInvalidClient)
+
+	_, err = auth.ValidateCode(code)
+	assert.True(t, apple.IsRetryable(err))
+
+	// The queue is drained and the code was not consumed by the failures.
+	_, err = auth.ValidateCode(code)
+	assert.NoError(t, err)
+}
+
+func TestServerSignIDToken(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	expired := srv.SignIDToken(map[string]interface{}{
+		"iss": "https://appleid.apple.com",
+		"aud": "com.example.app",
+		"sub": "001234.abcd",
+		"iat": time.Now().Add(-2 * time.Hour).Unix(),
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+
+	_, err := apple.VerifyIDTokenWithOptions(srv.KeySet(), expired, apple.IDTokenOptions{Audiences: []string{"com.example.app"}})
+	var idErr *apple.IDTokenError
+	if assert.ErrorAs(t, err, &idErr) {
+		assert.Equal(t, apple.IDTokenErrorExpired, idErr.Code)
+	}
+}
+
+func TestServerRejectsInvalidClientSecret(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	res, err := srv.Client().PostForm(srv.URL+TokenEndpoint, map[string][]string{
+		"client_id":     {"com.example.app"},
+		"client_secret": {"not-a-jwt"},
+		"grant_type":    {"authorization_code"},
+		"code":          {srv.IssueCode("001234.abcd", nil)},
+	})
+	assert.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
@@ -1,12 +1,24 @@
 package apple
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/json"
 	"strings"
+	"time"
+)
+
+var (
+	// oidAppleReceiptSigning marks the leaf certificates that sign App Store
+	// payloads.
+	oidAppleReceiptSigning = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 11, 1}
+	// oidAppleWWDRIntermediate marks the Apple Worldwide Developer Relations
+	// intermediate certificates issuing them.
+	oidAppleWWDRIntermediate = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 2, 1}
 )
 
 // AppStoreNotifications provides methods for parsing and verifying
@@ -29,14 +41,50 @@ type AppStoreNotifications interface {
 
 type appStoreNotifications struct {
 	rootCertPool *x509.CertPool
+	// atSignedDate validates certificate chains at the payload's signedDate
+	// instead of the current time.
+	atSignedDate bool
+	// ocsp, if set, checks the revocation status of the chains.
+	ocsp *OCSPChecker
+}
+
+// ASVerifierOption configures how NewAppStoreNotifications and
+// NewSignedDataVerifier verify signed payloads.
+type ASVerifierOption func(*appStoreNotifications)
+
+// WithSignedDateValidation validates the certificate chain at the signedDate
+// of each payload instead of the current time, so that payloads replayed
+// from the notification history still verify after the leaf certificate
+// expired. Payloads without a signedDate are validated at the current time.
+func WithSignedDateValidation() ASVerifierOption {
+	return func(a *appStoreNotifications) {
+		a.atSignedDate = true
+	}
+}
+
+// WithOCSP checks the revocation status of the leaf and intermediate
+// certificate of each payload with checker. Only payloads with a valid
+// signature are checked.
+func WithOCSP(checker *OCSPChecker) ASVerifierOption {
+	return func(a *appStoreNotifications) {
+		a.ocsp = checker
+	}
 }
 
 // NewAppStoreNotifications creates a new AppStoreNotifications instance.
 // The returned instance is safe for concurrent use.
-func NewAppStoreNotifications() AppStoreNotifications {
-	return &appStoreNotifications{
+func NewAppStoreNotifications(opts ...ASVerifierOption) AppStoreNotifications {
+	return newAppStoreNotifications(opts)
+}
+
+func newAppStoreNotifications(opts []ASVerifierOption) *appStoreNotifications {
+	a := &appStoreNotifications{
 		rootCertPool: appleRootCertPool(),
 	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
 }
 
 // ParseV1 parses a V1 App Store Server Notification from raw JSON bytes.
@@ -48,8 +96,21 @@ func (a *appStoreNotifications) ParseV1(payload []byte) (*ASNotificationV1, erro
 	return &notification, nil
 }
 
+// asContextParser is implemented by the AppStoreNotifications of this
+// package. ASNotificationHandler uses it to bound OCSP requests by the
+// context of the inbound request.
+type asContextParser interface {
+	parseV2(ctx context.Context, payload []byte) (*ASNotificationV2, error)
+	decodeTransactionInfo(ctx context.Context, signedTransactionInfo string) (*ASTransactionInfo, error)
+	decodeRenewalInfo(ctx context.Context, signedRenewalInfo string) (*ASRenewalInfo, error)
+}
+
 // ParseV2 parses and verifies a V2 App Store Server Notification.
 func (a *appStoreNotifications) ParseV2(payload []byte) (*ASNotificationV2, error) {
+	return a.parseV2(context.Background(), payload)
+}
+
+func (a *appStoreNotifications) parseV2(ctx context.Context, payload []byte) (*ASNotificationV2, error) {
 	var signed ASSignedPayload
 	if err := json.Unmarshal(payload, &signed); err != nil {
 		return nil, &ASError{Code: ASErrorInvalidPayload, Reason: err.Error()}
@@ -58,7 +119,7 @@ func (a *appStoreNotifications) ParseV2(payload []byte) (*ASNotificationV2, erro
 		return nil, &ASError{Code: ASErrorInvalidPayload, Reason: "missing signedPayload"}
 	}
 
-	decoded, err := verifyAndDecodeJWS(signed.SignedPayload, a.rootCertPool)
+	decoded, err := a.verifyAndDecodeJWS(ctx, signed.SignedPayload)
 	if err != nil {
 		return nil, err
 	}
@@ -72,7 +133,11 @@ func (a *appStoreNotifications) ParseV2(payload []byte) (*ASNotificationV2, erro
 
 // DecodeTransactionInfo decodes and verifies a signed transaction info JWS string.
 func (a *appStoreNotifications) DecodeTransactionInfo(signedTransactionInfo string) (*ASTransactionInfo, error) {
-	decoded, err := verifyAndDecodeJWS(signedTransactionInfo, a.rootCertPool)
+	return a.decodeTransactionInfo(context.Background(), signedTransactionInfo)
+}
+
+func (a *appStoreNotifications) decodeTransactionInfo(ctx context.Context, signedTransactionInfo string) (*ASTransactionInfo, error) {
+	decoded, err := a.verifyAndDecodeJWS(ctx, signedTransactionInfo)
 	if err != nil {
 		return nil, err
 	}
@@ -86,7 +151,11 @@ func (a *appStoreNotifications) DecodeTransactionInfo(signedTransactionInfo stri
 
 // DecodeRenewalInfo decodes and verifies a signed renewal info JWS string.
 func (a *appStoreNotifications) DecodeRenewalInfo(signedRenewalInfo string) (*ASRenewalInfo, error) {
-	decoded, err := verifyAndDecodeJWS(signedRenewalInfo, a.rootCertPool)
+	return a.decodeRenewalInfo(context.Background(), signedRenewalInfo)
+}
+
+func (a *appStoreNotifications) decodeRenewalInfo(ctx context.Context, signedRenewalInfo string) (*ASRenewalInfo, error) {
+	decoded, err := a.verifyAndDecodeJWS(ctx, signedRenewalInfo)
 	if err != nil {
 		return nil, err
 	}
@@ -104,9 +173,12 @@ type jwsHeader struct {
 	X5C []string `json:"x5c"`
 }
 
-// verifyAndDecodeJWS verifies a JWS token's signature against the provided root CA
-// certificate pool and returns the decoded payload.
-func verifyAndDecodeJWS(token string, rootCertPool *x509.CertPool) ([]byte, error) {
+// verifyAndDecodeJWS verifies a JWS token's signature against the root CA
+// certificate pool and returns the decoded payload. The leaf and intermediate
+// certificates must carry Apple's marker extensions, so that no other
+// certificate chaining to the root can sign payloads. ctx bounds the OCSP
+// requests, if any.
+func (a *appStoreNotifications) verifyAndDecodeJWS(ctx context.Context, token string) ([]byte, error) {
 	// Split into header.payload.signature
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
@@ -157,13 +229,21 @@ func verifyAndDecodeJWS(token string, rootCertPool *x509.CertPool) ([]byte, erro
 
 	// Verify the leaf certificate against the Apple Root CA - G3
 	leaf := certs[0]
-	_, err = leaf.Verify(x509.VerifyOptions{
-		Roots:         rootCertPool,
+	opts := x509.VerifyOptions{
+		Roots:         a.rootCertPool,
 		Intermediates: intermediates,
-	})
+	}
+	if a.atSignedDate {
+		opts.CurrentTime = payloadSignedDate(payloadB64)
+	}
+	chains, err := leaf.Verify(opts)
 	if err != nil {
 		return nil, &ASError{Code: ASErrorInvalidCertChain, Reason: err.Error()}
 	}
+	chain := appleSigningChain(chains)
+	if chain == nil {
+		return nil, &ASError{Code: ASErrorInvalidCertChain, Reason: "certificate chain is missing the Apple signing extensions"}
+	}
 
 	// Extract ECDSA public key from leaf
 	pubKey, ok := leaf.PublicKey.(*ecdsa.PublicKey)
@@ -184,6 +264,15 @@ func verifyAndDecodeJWS(token string, rootCertPool *x509.CertPool) ([]byte, erro
 		return nil, &ASError{Code: ASErrorSignatureInvalid, Reason: "signature verification failed"}
 	}
 
+	// Check revocation of the leaf and intermediate
+	if a.ocsp != nil {
+		for i := 0; i < 2; i++ {
+			if err := a.ocsp.Check(ctx, chain[i], chain[i+1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	// Decode payload
 	payloadBytes, err := base64.RawURLEncoding.DecodeString(payloadB64)
 	if err != nil {
@@ -192,3 +281,41 @@ func verifyAndDecodeJWS(token string, rootCertPool *x509.CertPool) ([]byte, erro
 
 	return payloadBytes, nil
 }
+
+// payloadSignedDate returns the signedDate of an encoded payload, or the
+// zero time, which x509 treats as the current time, if it has none. The
+// payload is not verified yet; the date is only trusted once the signature
+// checks out.
+func payloadSignedDate(payloadB64 string) time.Time {
+	var signed struct {
+		SignedDate int64 `json:"signedDate"`
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(payloadB64)
+	if err != nil {
+		return time.Time{}
+	}
+	if err := json.Unmarshal(payload, &signed); err != nil || signed.SignedDate <= 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(signed.SignedDate)
+}
+
+// appleSigningChain returns the first verified chain with the Apple marker
+// extensions on its leaf and intermediate certificate, or nil.
+func appleSigningChain(chains [][]*x509.Certificate) []*x509.Certificate {
+	for _, chain := range chains {
+		if len(chain) >= 3 && hasExtension(chain[0], oidAppleReceiptSigning) && hasExtension(chain[1], oidAppleWWDRIntermediate) {
+			return chain
+		}
+	}
+	return nil
+}
+
+func hasExtension(cert *x509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package apple
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultASNotificationTTL covers Apple's retries, which span about
+	// three days, and recent history replays.
+	defaultASNotificationTTL = 7 * 24 * time.Hour
+	// defaultASNotificationClaimTimeout releases the claim of a delivery
+	// that never completed, e.g. after a crash.
+	defaultASNotificationClaimTimeout = 5 * time.Minute
+)
+
+// ASNotificationOutcome is the processing state of a notification.
+type ASNotificationOutcome string
+
+const (
+	ASNotificationOutcomeProcessing ASNotificationOutcome = "PROCESSING"
+	ASNotificationOutcomeSucceeded  ASNotificationOutcome = "SUCCEEDED"
+	ASNotificationOutcomeFailed     ASNotificationOutcome = "FAILED"
+)
+
+// ASNotificationRecord is the stored state of a notification.
+type ASNotificationRecord struct {
+	NotificationUUID string
+	Outcome          ASNotificationOutcome
+	// Error is the message of the last failed attempt.
+	Error     string
+	Attempts  int
+	UpdatedAt time.Time
+}
+
+// ASNotificationStore records which notifications were processed, keyed on
+// ASNotificationV2.NotificationUUID. Implementations shared by several
+// instances, e.g. backed by a database, must make Claim atomic.
+type ASNotificationStore interface {
+	// Claim marks the notification as processing and reports whether the
+	// caller may process it. It returns false when the notification
+	// succeeded or is being processed by another delivery. A failed
+	// notification can be claimed again.
+	Claim(ctx context.Context, notificationUUID string) (bool, error)
+	// Complete records the outcome of a claimed notification. A nil
+	// procErr marks it succeeded, otherwise failed.
+	Complete(ctx context.Context, notificationUUID string, procErr error) error
+	// Load returns the record of a notification, or nil if it is unknown.
+	Load(ctx context.Context, notificationUUID string) (*ASNotificationRecord, error)
+}
+
+// ProcessASNotificationOnce runs fn unless the notification was already
+// processed successfully, and records the outcome in store. It returns
+// false without calling fn when the notification was processed before, and
+// an ASError with code ASErrorNotificationInProgress when another delivery
+// is processing it. If fn succeeds but its outcome cannot be stored, the
+// notification counts as processed and an ASError with code
+// ASErrorNotificationNotRecorded is returned; the notification stays
+// claimed until the claim timeout, so redeliveries are not processed again
+// meanwhile. Notifications without a UUID are always processed.
+func ProcessASNotificationOnce(ctx context.Context, store ASNotificationStore, n *ASNotificationV2, fn func() error) (bool, error) {
+	if n.NotificationUUID == "" {
+		return true, fn()
+	}
+
+	claimed, err := store.Claim(ctx, n.NotificationUUID)
+	if err != nil {
+		return false, err
+	}
+	if !claimed {
+		rec, err := store.Load(ctx, n.NotificationUUID)
+		if err != nil {
+			return false, err
+		}
+		if rec != nil && rec.Outcome == ASNotificationOutcomeSucceeded {
+			return false, nil
+		}
+		return false, &ASError{Code: ASErrorNotificationInProgress, Reason: n.NotificationUUID}
+	}
+
+	procErr := fn()
+	if err := store.Complete(ctx, n.NotificationUUID, procErr); err != nil && procErr == nil {
+		return true, &ASError{Code: ASErrorNotificationNotRecorded, Reason: err.Error()}
+	}
+	return true, procErr
+}
+
+// MemoryASNotificationStore is an in-memory ASNotificationStore for
+// single-instance deployments. A MemoryASNotificationStore is safe for
+// concurrent use.
+type MemoryASNotificationStore struct {
+	// TTL is how long a record is kept after its last update.
+	TTL time.Duration
+	// ClaimTimeout is how long a claim blocks other deliveries before it
+	// can be taken over.
+	ClaimTimeout time.Duration
+
+	mu      sync.Mutex
+	records map[string]*ASNotificationRecord
+	sweptAt time.Time
+}
+
+// NewMemoryASNotificationStore creates a MemoryASNotificationStore keeping
+// records for ttl.
+func NewMemoryASNotificationStore(ttl time.Duration) *MemoryASNotificationStore {
+	return &MemoryASNotificationStore{
+		TTL:          ttl,
+		ClaimTimeout: defaultASNotificationClaimTimeout,
+		records:      make(map[string]*ASNotificationRecord),
+	}
+}
+
+// Claim implements ASNotificationStore.
+func (s *MemoryASNotificationStore) Claim(_ context.Context, notificationUUID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	rec := s.record(now, notificationUUID)
+	if rec == nil {
+		rec = &ASNotificationRecord{NotificationUUID: notificationUUID}
+		s.records[notificationUUID] = rec
+	}
+	switch rec.Outcome {
+	case ASNotificationOutcomeSucceeded:
+		return false, nil
+	case ASNotificationOutcomeProcessing:
+		if now.Sub(rec.UpdatedAt) < s.claimTimeout() {
+			return false, nil
+		}
+	}
+	rec.Outcome = ASNotificationOutcomeProcessing
+	rec.Attempts++
+	rec.UpdatedAt = now
+	return true, nil
+}
+
+// Complete implements ASNotificationStore.
+func (s *MemoryASNotificationStore) Complete(_ context.Context, notificationUUID string, procErr error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.records[notificationUUID]
+	if !ok {
+		rec = &ASNotificationRecord{NotificationUUID: notificationUUID, Attempts: 1}
+		s.records[notificationUUID] = rec
+	}
+	rec.Outcome, rec.Error = ASNotificationOutcomeSucceeded, ""
+	if procErr != nil {
+		rec.Outcome, rec.Error = ASNotificationOutcomeFailed, procErr.Error()
+	}
+	rec.UpdatedAt = time.Now()
+	return nil
+}
+
+// Load implements ASNotificationStore.
+func (s *MemoryASNotificationStore) Load(_ context.Context, notificationUUID string) (*ASNotificationRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec := s.record(time.Now(), notificationUUID)
+	if rec == nil {
+		return nil, nil
+	}
+	copied := *rec
+	return &copied, nil
+}
+
+// record returns the unexpired record of notificationUUID, or nil. Expired
+// records of other notifications are swept at most once per
+// memorySweepInterval.
+func (s *MemoryASNotificationStore) record(now time.Time, notificationUUID string) *ASNotificationRecord {
+	ttl := s.TTL
+	if ttl <= 0 {
+		ttl = defaultASNotificationTTL
+	}
+	if now.Sub(s.sweptAt) >= memorySweepInterval {
+		s.sweptAt = now
+		for k, rec := range s.records {
+			if now.Sub(rec.UpdatedAt) > ttl {
+				delete(s.records, k)
+			}
+		}
+	}
+
+	rec, ok := s.records[notificationUUID]
+	if !ok {
+		return nil
+	}
+	if now.Sub(rec.UpdatedAt) > ttl {
+		delete(s.records, notificationUUID)
+		return nil
+	}
+	return rec
+}
+
+func (s *MemoryASNotificationStore) claimTimeout() time.Duration {
+	if s.ClaimTimeout <= 0 {
+		return defaultASNotificationClaimTimeout
+	}
+	return s.ClaimTimeout
+}
@@ -0,0 +1,192 @@
+package apple
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessASNotificationOnceConcurrent(t *testing.T) {
+	store := NewMemoryASNotificationStore(time.Hour)
+	n := &ASNotificationV2{NotificationUUID: "uuid-1"}
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = ProcessASNotificationOnce(context.Background(), store, n, func() error {
+				calls.Add(1)
+				<-release
+				return nil
+			})
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+
+	// A redelivery after success is skipped.
+	processed, err := ProcessASNotificationOnce(context.Background(), store, n, func() error {
+		t.Fatal("processed twice")
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.False(t, processed)
+}
+
+func TestProcessASNotificationOnceRetriesFailures(t *testing.T) {
+	store := NewMemoryASNotificationStore(time.Hour)
+	n := &ASNotificationV2{NotificationUUID: "uuid-1"}
+
+	processed, err := ProcessASNotificationOnce(context.Background(), store, n, func() error {
+		return errors.New("database unavailable")
+	})
+	assert.True(t, processed)
+	assert.EqualError(t, err, "database unavailable")
+
+	rec, err := store.Load(context.Background(), "uuid-1")
+	assert.NoError(t, err)
+	assert.Equal(t, ASNotificationOutcomeFailed, rec.Outcome)
+	assert.Equal(t, "database unavailable", rec.Error)
+
+	processed, err = ProcessASNotificationOnce(context.Background(), store, n, func() error { return nil })
+	assert.True(t, processed)
+	assert.NoError(t, err)
+
+	rec, err = store.Load(context.Background(), "uuid-1")
+	assert.NoError(t, err)
+	assert.Equal(t, ASNotificationOutcomeSucceeded, rec.Outcome)
+	assert.Empty(t, rec.Error)
+	assert.Equal(t, 2, rec.Attempts)
+}
+
+func TestProcessASNotificationOnceInProgress(t *testing.T) {
+	store := NewMemoryASNotificationStore(time.Hour)
+	n := &ASNotificationV2{NotificationUUID: "uuid-1"}
+
+	claimed, err := store.Claim(context.Background(), "uuid-1")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	_, err = ProcessASNotificationOnce(context.Background(), store, n, func() error { return nil })
+	var asErr *ASError
+	if assert.ErrorAs(t, err, &asErr) {
+		assert.Equal(t, ASErrorNotificationInProgress, asErr.Code)
+	}
+
+	// An abandoned claim is taken over after the claim timeout.
+	store.ClaimTimeout = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	processed, err := ProcessASNotificationOnce(context.Background(), store, n, func() error { return nil })
+	assert.NoError(t, err)
+	assert.True(t, processed)
+}
+
+func TestMemoryASNotificationStoreTTL(t *testing.T) {
+	store := NewMemoryASNotificationStore(10 * time.Millisecond)
+	ctx := context.Background()
+
+	_, _ = store.Claim(ctx, "uuid-1")
+	assert.NoError(t, store.Complete(ctx, "uuid-1", nil))
+	claimed, _ := store.Claim(ctx, "uuid-1")
+	assert.False(t, claimed)
+
+	time.Sleep(20 * time.Millisecond)
+	rec, err := store.Load(ctx, "uuid-1")
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+	claimed, _ = store.Claim(ctx, "uuid-1")
+	assert.True(t, claimed)
+}
+
+func TestASNotificationHandlerStore(t *testing.T) {
+	chain := generateTestCertChain(t)
+
+	fail := true
+	calls := 0
+	h := &ASNotificationHandler{
+		Notifications: newTestAppStore(chain.rootPool),
+		Store:         NewMemoryASNotificationStore(time.Hour),
+		OnDidRenew: func(r *http.Request, e *ASNotificationEvent) error {
+			calls++
+			if fail {
+				return errors.New("database unavailable")
+			}
+			return nil
+		},
+	}
+	body := testASNotificationBody(t, chain, ASNotificationTypeDidRenew, "uuid-1")
+
+	// A failed attempt is retried, a succeeded one is not repeated.
+	assert.Equal(t, http.StatusInternalServerError, serveASNotification(h, "POST", body))
+	fail = false
+	assert.Equal(t, http.StatusOK, serveASNotification(h, "POST", body))
+	assert.Equal(t, http.StatusOK, serveASNotification(h, "POST", body))
+	assert.Equal(t, 2, calls)
+
+	// A delivery racing one in progress is rejected for a later retry.
+	_, _ = h.Store.Claim(context.Background(), "uuid-2")
+	assert.Equal(t, http.StatusConflict, serveASNotification(h, "POST", testASNotificationBody(t, chain, ASNotificationTypeDidRenew, "uuid-2")))
+	assert.Equal(t, 2, calls)
+}
+
+// failingCompleteStore is a MemoryASNotificationStore whose Complete fails.
+type failingCompleteStore struct {
+	*MemoryASNotificationStore
+}
+
+func (s failingCompleteStore) Complete(context.Context, string, error) error {
+	return errors.New("store unavailable")
+}
+
+func TestASNotificationHandlerCompleteError(t *testing.T) {
+	chain := generateTestCertChain(t)
+
+	calls := 0
+	var storeErr error
+	h := &ASNotificationHandler{
+		Notifications: newTestAppStore(chain.rootPool),
+		Store:         failingCompleteStore{NewMemoryASNotificationStore(time.Hour)},
+		OnStoreError:  func(r *http.Request, err error) { storeErr = err },
+		OnDidRenew: func(r *http.Request, e *ASNotificationEvent) error {
+			calls++
+			return nil
+		},
+	}
+	body := testASNotificationBody(t, chain, ASNotificationTypeDidRenew, "uuid-1")
+
+	// The processed notification is acknowledged and not run again.
+	assert.Equal(t, http.StatusOK, serveASNotification(h, "POST", body))
+	assertASErrorCode(t, storeErr, ASErrorNotificationNotRecorded)
+	assert.Equal(t, http.StatusConflict, serveASNotification(h, "POST", body))
+	assert.Equal(t, 1, calls)
+}
+
+func TestMemoryASNotificationStoreSweep(t *testing.T) {
+	store := NewMemoryASNotificationStore(time.Hour)
+	ctx := context.Background()
+
+	for _, id := range []string{"uuid-1", "uuid-2"} {
+		_, _ = store.Claim(ctx, id)
+		assert.NoError(t, store.Complete(ctx, id, nil))
+	}
+	store.records["uuid-1"].UpdatedAt = time.Now().Add(-2 * time.Hour)
+
+	// Other records are swept at most once per sweep interval.
+	_, _ = store.Load(ctx, "uuid-2")
+	assert.Len(t, store.records, 2)
+
+	store.sweptAt = time.Now().Add(-memorySweepInterval)
+	_, _ = store.Load(ctx, "uuid-2")
+	assert.Len(t, store.records, 1)
+}
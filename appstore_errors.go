@@ -13,6 +13,22 @@ const (
 	ASErrorUnsupportedAlgo    ASErrorCode = "UNSUPPORTED_ALGORITHM"
 	ASErrorInvalidCertChain   ASErrorCode = "INVALID_CERT_CHAIN"
 	ASErrorDecodeError        ASErrorCode = "DECODE_ERROR"
+	ASErrorInvalidBundleID    ASErrorCode = "INVALID_BUNDLE_ID"
+	ASErrorInvalidAppAppleID  ASErrorCode = "INVALID_APP_APPLE_ID"
+	ASErrorInvalidEnvironment ASErrorCode = "INVALID_ENVIRONMENT"
+	ASErrorCertificateRevoked ASErrorCode = "CERTIFICATE_REVOKED"
+
+	// ASErrorRevocationCheckFailed means the revocation status of a
+	// certificate could not be determined.
+	ASErrorRevocationCheckFailed ASErrorCode = "REVOCATION_CHECK_FAILED"
+
+	// ASErrorNotificationInProgress means another delivery of the same
+	// notification is being processed.
+	ASErrorNotificationInProgress ASErrorCode = "NOTIFICATION_IN_PROGRESS"
+
+	// ASErrorNotificationNotRecorded means a notification was processed
+	// successfully but the outcome could not be stored.
+	ASErrorNotificationNotRecorded ASErrorCode = "NOTIFICATION_NOT_RECORDED"
 )
 
 // ASError represents an App Store notification processing error.
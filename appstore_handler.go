@@ -0,0 +1,230 @@
+package apple
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// defaultASNotificationBodySize is the default limit of a notification
+// request body.
+const defaultASNotificationBodySize = 1 << 20
+
+// ASNotificationEvent is a verified V2 notification with its signed
+// transaction and renewal info decoded. Transaction and Renewal are nil
+// when the notification does not carry them.
+type ASNotificationEvent struct {
+	Notification *ASNotificationV2
+	Transaction  *ASTransactionInfo
+	Renewal      *ASRenewalInfo
+}
+
+// ASNotificationCallback handles one notification type. Returning an error
+// makes the handler reply with 500 so that Apple retries the delivery.
+type ASNotificationCallback func(r *http.Request, e *ASNotificationEvent) error
+
+// ASNotificationHandler is an http.Handler for the App Store Server
+// Notifications V2 endpoint. It verifies each notification with ParseV2,
+// decodes the nested signed data and dispatches the event to the callback
+// of its type; the subtype is available on the event. Invalid requests are
+// answered with 4xx, callback errors with 500. Types without a callback go
+// to OnOther, or are acknowledged if it is not set.
+type ASNotificationHandler struct {
+	// Notifications verifies the payloads. Required.
+	Notifications AppStoreNotifications
+	// MaxBodySize limits the request body. Defaults to 1 MiB.
+	MaxBodySize int64
+	// Store, if set, makes the handler process each notification at most
+	// once. Redeliveries of a processed notification are acknowledged
+	// without calling back; deliveries racing an attempt in progress are
+	// answered with 409 so that Apple retries them later.
+	Store ASNotificationStore
+	// OnStoreError, if set, is called when a notification was processed
+	// but Store failed to record it. The delivery is still acknowledged.
+	OnStoreError func(r *http.Request, err error)
+
+	OnSubscribed             ASNotificationCallback
+	OnDidRenew               ASNotificationCallback
+	OnDidFailToRenew         ASNotificationCallback
+	OnDidChangeRenewalPref   ASNotificationCallback
+	OnDidChangeRenewalStatus ASNotificationCallback
+	OnExpired                ASNotificationCallback
+	OnGracePeriodExpired     ASNotificationCallback
+	OnPriceIncrease          ASNotificationCallback
+	OnOfferRedeemed          ASNotificationCallback
+	OnRefund                 ASNotificationCallback
+	OnRefundDeclined         ASNotificationCallback
+	OnRefundReversed         ASNotificationCallback
+	OnConsumptionRequest     ASNotificationCallback
+	OnRenewalExtended        ASNotificationCallback
+	OnRenewalExtension       ASNotificationCallback
+	OnRevoke                 ASNotificationCallback
+	OnExternalPurchaseToken  ASNotificationCallback
+	OnOneTimeCharge          ASNotificationCallback
+	OnTest                   ASNotificationCallback
+	// OnOther receives every type without its own callback, including
+	// types added by Apple after this package.
+	OnOther ASNotificationCallback
+}
+
+// ServeHTTP implements http.Handler.
+func (h *ASNotificationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	maxBodySize := h.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultASNotificationBodySize
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		status := http.StatusBadRequest
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	event, err := h.parse(r.Context(), body)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	dispatch := func() error {
+		if callback := h.callback(event.Notification.NotificationType); callback != nil {
+			return callback(r, event)
+		}
+		return nil
+	}
+	if h.Store == nil {
+		err = dispatch()
+	} else {
+		var processed bool
+		processed, err = ProcessASNotificationOnce(r.Context(), h.Store, event.Notification, dispatch)
+		var asErr *ASError
+		if errors.As(err, &asErr) && asErr.Code == ASErrorNotificationInProgress {
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+			return
+		}
+		if errors.As(err, &asErr) && asErr.Code == ASErrorNotificationNotRecorded {
+			// The callback succeeded; a retry must not run it again.
+			if h.OnStoreError != nil {
+				h.OnStoreError(r, err)
+			}
+			err = nil
+		}
+		if err != nil && !processed {
+			// The store failed before the callback ran.
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// parse verifies the notification and decodes its signed data. ctx bounds
+// the OCSP requests of the verifiers of this package.
+func (h *ASNotificationHandler) parse(ctx context.Context, body []byte) (*ASNotificationEvent, error) {
+	parser, ok := h.Notifications.(asContextParser)
+	if !ok {
+		parser = withoutContext{h.Notifications}
+	}
+
+	n, err := parser.parseV2(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &ASNotificationEvent{Notification: n}
+	if n.Data == nil {
+		return event, nil
+	}
+	if n.Data.SignedTransactionInfo != "" {
+		if event.Transaction, err = parser.decodeTransactionInfo(ctx, n.Data.SignedTransactionInfo); err != nil {
+			return nil, err
+		}
+	}
+	if n.Data.SignedRenewalInfo != "" {
+		if event.Renewal, err = parser.decodeRenewalInfo(ctx, n.Data.SignedRenewalInfo); err != nil {
+			return nil, err
+		}
+	}
+	return event, nil
+}
+
+// withoutContext adapts an AppStoreNotifications of another package to
+// asContextParser by dropping the context.
+type withoutContext struct {
+	AppStoreNotifications
+}
+
+func (p withoutContext) parseV2(_ context.Context, payload []byte) (*ASNotificationV2, error) {
+	return p.ParseV2(payload)
+}
+
+func (p withoutContext) decodeTransactionInfo(_ context.Context, signedTransactionInfo string) (*ASTransactionInfo, error) {
+	return p.DecodeTransactionInfo(signedTransactionInfo)
+}
+
+func (p withoutContext) decodeRenewalInfo(_ context.Context, signedRenewalInfo string) (*ASRenewalInfo, error) {
+	return p.DecodeRenewalInfo(signedRenewalInfo)
+}
+
+// callback returns the callback for a notification type.
+func (h *ASNotificationHandler) callback(t ASNotificationType) ASNotificationCallback {
+	var callback ASNotificationCallback
+	switch t {
+	case ASNotificationTypeSubscribed:
+		callback = h.OnSubscribed
+	case ASNotificationTypeDidRenew:
+		callback = h.OnDidRenew
+	case ASNotificationTypeDidFailToRenew:
+		callback = h.OnDidFailToRenew
+	case ASNotificationTypeDidChangeRenewalPref:
+		callback = h.OnDidChangeRenewalPref
+	case ASNotificationTypeDidChangeRenewalStat:
+		callback = h.OnDidChangeRenewalStatus
+	case ASNotificationTypeExpired:
+		callback = h.OnExpired
+	case ASNotificationTypeGracePeriodExpired:
+		callback = h.OnGracePeriodExpired
+	case ASNotificationTypePriceIncrease:
+		callback = h.OnPriceIncrease
+	case ASNotificationTypeOfferRedeemed:
+		callback = h.OnOfferRedeemed
+	case ASNotificationTypeRefund:
+		callback = h.OnRefund
+	case ASNotificationTypeRefundDeclined:
+		callback = h.OnRefundDeclined
+	case ASNotificationTypeRefundReversed:
+		callback = h.OnRefundReversed
+	case ASNotificationTypeConsumptionRequest:
+		callback = h.OnConsumptionRequest
+	case ASNotificationTypeRenewalExtended:
+		callback = h.OnRenewalExtended
+	case ASNotificationTypeRenewalExtension:
+		callback = h.OnRenewalExtension
+	case ASNotificationTypeRevoke:
+		callback = h.OnRevoke
+	case ASNotificationTypeExternalPurchaseToken:
+		callback = h.OnExternalPurchaseToken
+	case ASNotificationTypeOneTimeCharge:
+		callback = h.OnOneTimeCharge
+	case ASNotificationTypeTest:
+		callback = h.OnTest
+	}
+	if callback == nil {
+		callback = h.OnOther
+	}
+	return callback
+}
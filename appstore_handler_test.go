@@ -0,0 +1,114 @@
+package apple
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testASNotificationBody signs a V2 notification with nested transaction
+// and renewal info and wraps it in the request envelope.
+func testASNotificationBody(t *testing.T, chain *testCertChain, notificationType ASNotificationType, uuid string) []byte {
+	txn, err := json.Marshal(ASTransactionInfo{TransactionID: "txn-1", ProductID: "com.example.premium"})
+	assert.NoError(t, err)
+	renewal, err := json.Marshal(ASRenewalInfo{AutoRenewProductID: "com.example.premium", AutoRenewStatus: 1})
+	assert.NoError(t, err)
+
+	payload, err := json.Marshal(ASNotificationV2{
+		NotificationType: notificationType,
+		NotificationUUID: uuid,
+		Version:          "2.0",
+		SignedDate:       1700000000000,
+		Data: &ASNotificationData{
+			AppAppleID:            123456789,
+			BundleID:              "com.example.app",
+			Environment:           ASEnvironmentSandbox,
+			SignedTransactionInfo: createTestJWS(t, chain, txn),
+			SignedRenewalInfo:     createTestJWS(t, chain, renewal),
+		},
+	})
+	assert.NoError(t, err)
+
+	body, err := json.Marshal(ASSignedPayload{SignedPayload: createTestJWS(t, chain, payload)})
+	assert.NoError(t, err)
+	return body
+}
+
+func serveASNotification(h http.Handler, method string, body []byte) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, "/appstore/notifications", strings.NewReader(string(body))))
+	return rec.Code
+}
+
+func TestASNotificationHandler(t *testing.T) {
+	chain := generateTestCertChain(t)
+
+	var subscribed []*ASNotificationEvent
+	var others []ASNotificationType
+	h := &ASNotificationHandler{
+		Notifications: newTestAppStore(chain.rootPool),
+		OnSubscribed: func(r *http.Request, e *ASNotificationEvent) error {
+			subscribed = append(subscribed, e)
+			return nil
+		},
+		OnRefund: func(r *http.Request, e *ASNotificationEvent) error {
+			return errors.New("database unavailable")
+		},
+		OnOther: func(r *http.Request, e *ASNotificationEvent) error {
+			others = append(others, e.Notification.NotificationType)
+			return nil
+		},
+	}
+
+	assert.Equal(t, http.StatusOK, serveASNotification(h, "POST", testASNotificationBody(t, chain, ASNotificationTypeSubscribed, "uuid-1")))
+	if assert.Len(t, subscribed, 1) {
+		e := subscribed[0]
+		assert.Equal(t, "uuid-1", e.Notification.NotificationUUID)
+		assert.Equal(t, "txn-1", e.Transaction.TransactionID)
+		assert.Equal(t, "com.example.premium", e.Renewal.AutoRenewProductID)
+	}
+
+	// A failing callback makes Apple retry.
+	assert.Equal(t, http.StatusInternalServerError, serveASNotification(h, "POST", testASNotificationBody(t, chain, ASNotificationTypeRefund, "uuid-2")))
+
+	// Types without their own callback go to OnOther.
+	assert.Equal(t, http.StatusOK, serveASNotification(h, "POST", testASNotificationBody(t, chain, ASNotificationTypeDidRenew, "uuid-3")))
+	assert.Equal(t, []ASNotificationType{ASNotificationTypeDidRenew}, others)
+}
+
+func TestASNotificationHandlerUnhandled(t *testing.T) {
+	chain := generateTestCertChain(t)
+	h := &ASNotificationHandler{Notifications: newTestAppStore(chain.rootPool)}
+
+	// Without a callback the notification is acknowledged.
+	assert.Equal(t, http.StatusOK, serveASNotification(h, "POST", testASNotificationBody(t, chain, ASNotificationTypeTest, "uuid-1")))
+}
+
+func TestASNotificationHandlerRejects(t *testing.T) {
+	chain := generateTestCertChain(t)
+	called := false
+	h := &ASNotificationHandler{
+		Notifications: newTestAppStore(chain.rootPool),
+		MaxBodySize:   64,
+		OnOther: func(r *http.Request, e *ASNotificationEvent) error {
+			called = true
+			return nil
+		},
+	}
+
+	assert.Equal(t, http.StatusMethodNotAllowed, serveASNotification(h, "GET", nil))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serveASNotification(h, "POST", testASNotificationBody(t, chain, ASNotificationTypeTest, "uuid-1")))
+
+	h.MaxBodySize = 0
+	assert.Equal(t, http.StatusBadRequest, serveASNotification(h, "POST", []byte(`{"signedPayload":"forged"}`)))
+
+	// A notification signed under another root is rejected.
+	other := generateTestCertChain(t)
+	assert.Equal(t, http.StatusBadRequest, serveASNotification(h, "POST", testASNotificationBody(t, other, ASNotificationTypeTest, "uuid-2")))
+	assert.False(t, called)
+}
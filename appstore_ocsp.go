@@ -0,0 +1,151 @@
+package apple
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// maxOCSPResponseSize limits the size of an OCSP response body.
+const maxOCSPResponseSize = 1 << 20
+
+type ocspHTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// OCSPChecker checks the revocation status of the leaf and intermediate
+// certificates of App Store JWS chains with the OCSP responder named in
+// their Authority Information Access extension. Responses are cached until
+// their NextUpdate. Pass it to NewAppStoreNotifications or
+// NewSignedDataVerifier with WithOCSP. An OCSPChecker is safe for
+// concurrent use.
+type OCSPChecker struct {
+	// FailOpen accepts certificates whose status cannot be determined, e.g.
+	// because the responder is unreachable. Revoked certificates are always
+	// rejected. By default such certificates are rejected.
+	FailOpen bool
+
+	httpClient ocspHTTPClient
+	now        func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]ocspCacheEntry
+}
+
+type ocspCacheEntry struct {
+	status     int
+	nextUpdate time.Time
+}
+
+// NewOCSPChecker creates a fail-closed OCSPChecker. Use WithHTTPClient to
+// send the OCSP requests through a custom client.
+func NewOCSPChecker(opts ...Option) *OCSPChecker {
+	o := newClientOptions(10*time.Second, opts)
+	return &OCSPChecker{
+		httpClient: o.client(),
+		now:        o.now,
+		cache:      make(map[string]ocspCacheEntry),
+	}
+}
+
+// Check returns an ASError with code ASErrorCertificateRevoked if cert was
+// revoked by issuer, and one with code ASErrorRevocationCheckFailed if its
+// status cannot be determined and the checker is not FailOpen.
+func (c *OCSPChecker) Check(ctx context.Context, cert, issuer *x509.Certificate) error {
+	status, err := c.status(ctx, cert, issuer)
+	if err != nil {
+		if c.FailOpen {
+			return nil
+		}
+		return &ASError{Code: ASErrorRevocationCheckFailed, Reason: err.Error()}
+	}
+	switch status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return &ASError{Code: ASErrorCertificateRevoked, Reason: cert.Subject.CommonName}
+	}
+	if c.FailOpen {
+		return nil
+	}
+	return &ASError{Code: ASErrorRevocationCheckFailed, Reason: "unknown certificate status"}
+}
+
+// status returns the cached or fetched OCSP status of cert.
+func (c *OCSPChecker) status(ctx context.Context, cert, issuer *x509.Certificate) (int, error) {
+	key := fmt.Sprintf("%x:%s", sha256.Sum256(issuer.RawSubjectPublicKeyInfo), cert.SerialNumber)
+	now := c.now()
+
+	c.mu.Lock()
+	e, ok := c.cache[key]
+	if ok && now.After(e.nextUpdate) {
+		delete(c.cache, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if ok {
+		return e.status, nil
+	}
+
+	res, err := c.fetch(ctx, cert, issuer)
+	if err != nil {
+		return 0, err
+	}
+	if res.ThisUpdate.After(now.Add(time.Minute)) {
+		return 0, fmt.Errorf("ocsp response is not valid yet")
+	}
+	// Without NextUpdate newer information is always available, so the
+	// response is not cached.
+	if !res.NextUpdate.IsZero() {
+		if now.After(res.NextUpdate) {
+			return 0, fmt.Errorf("ocsp response is stale")
+		}
+		c.mu.Lock()
+		c.cache[key] = ocspCacheEntry{status: res.Status, nextUpdate: res.NextUpdate}
+		c.mu.Unlock()
+	}
+	return res.Status, nil
+}
+
+// fetch asks the first OCSP responder of cert for its status. The response
+// must be signed by issuer or a responder it delegated to.
+func (c *OCSPChecker) fetch(ctx context.Context, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	if len(cert.OCSPServer) == 0 {
+		return nil, fmt.Errorf("certificate %q has no ocsp responder", cert.Subject.CommonName)
+	}
+
+	body, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cert.OCSPServer[0], bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ocsp responder returned status %d", res.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(res.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	return ocsp.ParseResponseForCert(raw, cert, issuer)
+}
@@ -0,0 +1,201 @@
+package apple
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testOCSPResponder answers OCSP requests for a test cert chain.
+type testOCSPResponder struct {
+	server *httptest.Server
+	chain  *testCertChain
+
+	mu       sync.Mutex
+	requests int
+	// fail makes the responder answer with 500.
+	fail bool
+	// revoked holds the revoked serial numbers.
+	revoked map[int64]bool
+	// validity is the time from ThisUpdate to NextUpdate.
+	validity time.Duration
+	// block, if set, holds every request until it is closed.
+	block chan struct{}
+}
+
+func newTestOCSPResponder(t *testing.T) *testOCSPResponder {
+	r := &testOCSPResponder{revoked: map[int64]bool{}, validity: time.Hour}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	t.Cleanup(r.server.Close)
+	r.chain = generateTestCertChainWith(t, testCertChainConfig{ocspServer: r.server.URL})
+	return r
+}
+
+func (r *testOCSPResponder) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.block != nil {
+		<-r.block
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if r.fail {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	body, _ := io.ReadAll(req.Body)
+	ocspReq, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The leaf is issued by the intermediate, the intermediate by the root.
+	issuer, key := r.chain.intermediateCert, r.chain.intermediateKey
+	if ocspReq.SerialNumber.Cmp(r.chain.intermediateCert.SerialNumber) == 0 {
+		issuer, key = r.chain.rootCert, r.chain.rootKey
+	}
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: ocspReq.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(r.validity),
+	}
+	if r.revoked[ocspReq.SerialNumber.Int64()] {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = time.Now().Add(-time.Minute)
+	}
+	res, err := ocsp.CreateResponse(issuer, issuer, template, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	_, _ = w.Write(res)
+}
+
+func (r *testOCSPResponder) requestCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests
+}
+
+func (r *testOCSPResponder) notifications(checker *OCSPChecker) *appStoreNotifications {
+	as := newAppStoreNotifications([]ASVerifierOption{WithOCSP(checker)})
+	as.rootCertPool = r.chain.rootPool
+	return as
+}
+
+func (r *testOCSPResponder) envelope(t *testing.T) []byte {
+	payload, _ := json.Marshal(ASNotificationV2{NotificationType: ASNotificationTypeTest})
+	body, _ := json.Marshal(ASSignedPayload{SignedPayload: createTestJWS(t, r.chain, payload)})
+	return body
+}
+
+func TestOCSPCheckerGood(t *testing.T) {
+	r := newTestOCSPResponder(t)
+	as := r.notifications(NewOCSPChecker(WithHTTPClient(r.server.Client())))
+
+	_, err := as.ParseV2(r.envelope(t))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, r.requestCount())
+
+	// The responses are cached until their NextUpdate.
+	_, err = as.ParseV2(r.envelope(t))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, r.requestCount())
+}
+
+func TestOCSPCheckerCacheExpiry(t *testing.T) {
+	r := newTestOCSPResponder(t)
+	now := time.Now()
+	as := r.notifications(NewOCSPChecker(WithHTTPClient(r.server.Client()), WithClock(func() time.Time { return now })))
+
+	_, err := as.ParseV2(r.envelope(t))
+	assert.NoError(t, err)
+
+	now = now.Add(2 * time.Hour)
+	r.validity = 3 * time.Hour
+	_, err = as.ParseV2(r.envelope(t))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, r.requestCount())
+}
+
+func TestOCSPCheckerRevoked(t *testing.T) {
+	r := newTestOCSPResponder(t)
+	r.revoked[r.chain.leafCert.SerialNumber.Int64()] = true
+
+	checker := NewOCSPChecker(WithHTTPClient(r.server.Client()))
+	checker.FailOpen = true
+	_, err := r.notifications(checker).ParseV2(r.envelope(t))
+	assertASErrorCode(t, err, ASErrorCertificateRevoked)
+
+	// A revoked intermediate is rejected as well.
+	r = newTestOCSPResponder(t)
+	r.revoked[r.chain.intermediateCert.SerialNumber.Int64()] = true
+	_, err = r.notifications(NewOCSPChecker(WithHTTPClient(r.server.Client()))).ParseV2(r.envelope(t))
+	assertASErrorCode(t, err, ASErrorCertificateRevoked)
+}
+
+func TestOCSPCheckerUnavailable(t *testing.T) {
+	r := newTestOCSPResponder(t)
+	r.fail = true
+
+	checker := NewOCSPChecker(WithHTTPClient(r.server.Client()))
+	_, err := r.notifications(checker).ParseV2(r.envelope(t))
+	assertASErrorCode(t, err, ASErrorRevocationCheckFailed)
+
+	checker.FailOpen = true
+	_, err = r.notifications(checker).ParseV2(r.envelope(t))
+	assert.NoError(t, err)
+}
+
+func TestOCSPCheckerForgedResponse(t *testing.T) {
+	r := newTestOCSPResponder(t)
+	// The responder signs with the keys of another chain.
+	other := generateTestCertChain(t)
+	r.chain.rootKey, r.chain.intermediateKey = other.rootKey, other.intermediateKey
+
+	_, err := r.notifications(NewOCSPChecker(WithHTTPClient(r.server.Client()))).ParseV2(r.envelope(t))
+	assertASErrorCode(t, err, ASErrorRevocationCheckFailed)
+}
+
+func TestOCSPCheckerHandlerContext(t *testing.T) {
+	r := newTestOCSPResponder(t)
+	r.block = make(chan struct{})
+	defer close(r.block)
+
+	h := &ASNotificationHandler{Notifications: r.notifications(NewOCSPChecker(WithHTTPClient(r.server.Client())))}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("POST", "/appstore/notifications", bytes.NewReader(r.envelope(t))).WithContext(ctx)
+
+	// The hanging responder is abandoned with the inbound request.
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestOCSPCheckerSkipsInvalidSignatures(t *testing.T) {
+	r := newTestOCSPResponder(t)
+	as := r.notifications(NewOCSPChecker(WithHTTPClient(r.server.Client())))
+
+	jws := createTestJWS(t, r.chain, []byte(`{"notificationType":"TEST"}`))
+	parts := splitJWS(jws)
+	body, _ := json.Marshal(ASSignedPayload{SignedPayload: parts[0] + "." + parts[1] + ".AAAA" + parts[2][4:]})
+
+	_, err := as.ParseV2(body)
+	assertASErrorCode(t, err, ASErrorSignatureInvalid)
+	assert.Equal(t, 0, r.requestCount())
+}
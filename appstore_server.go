@@ -55,42 +55,60 @@ type appStoreServer struct {
 	keyID        string
 	bundleID     string
 	keyContent   []byte
+	signer       Signer
 	baseURL      string
 	httpClient   asHTTPClient
 	rootCertPool *x509.CertPool
+	now          func() time.Time
 }
 
 // NewAppStoreServerAPI creates a new App Store Server API client using a key file path.
-func NewAppStoreServerAPI(issuerID, keyID, bundleID, keyPath string, sandbox bool) (AppStoreServerAPI, error) {
+func NewAppStoreServerAPI(issuerID, keyID, bundleID, keyPath string, sandbox bool, opts ...Option) (AppStoreServerAPI, error) {
 	keyContent, err := os.ReadFile(keyPath)
 	if err != nil {
 		return nil, err
 	}
-	return newAppStoreServer(issuerID, keyID, bundleID, keyContent, sandbox), nil
+	return newAppStoreServer(issuerID, keyID, bundleID, keyContent, sandbox, opts...), nil
 }
 
 // NewAppStoreServerAPIB64 creates a new App Store Server API client using a base64-encoded key.
-func NewAppStoreServerAPIB64(issuerID, keyID, bundleID, b64Key string, sandbox bool) (AppStoreServerAPI, error) {
+func NewAppStoreServerAPIB64(issuerID, keyID, bundleID, b64Key string, sandbox bool, opts ...Option) (AppStoreServerAPI, error) {
 	keyContent, err := base64.StdEncoding.DecodeString(b64Key)
 	if err != nil {
 		return nil, err
 	}
-	return newAppStoreServer(issuerID, keyID, bundleID, keyContent, sandbox), nil
+	return newAppStoreServer(issuerID, keyID, bundleID, keyContent, sandbox, opts...), nil
 }
 
-func newAppStoreServer(issuerID, keyID, bundleID string, keyContent []byte, sandbox bool) *appStoreServer {
+// NewAppStoreServerAPIWithSigner creates a new App Store Server API client
+// that signs its tokens with signer, e.g. with a key held in a KMS.
+func NewAppStoreServerAPIWithSigner(issuerID, bundleID string, signer Signer, sandbox bool, opts ...Option) (AppStoreServerAPI, error) {
+	if signer == nil {
+		return nil, errNilSigner
+	}
+	s := newAppStoreServer(issuerID, signer.KeyID(), bundleID, nil, sandbox, opts...)
+	s.signer = signer
+	return s, nil
+}
+
+func newAppStoreServer(issuerID, keyID, bundleID string, keyContent []byte, sandbox bool, opts ...Option) *appStoreServer {
+	o := newClientOptions(30*time.Second, opts)
 	baseURL := asProductionBaseURL
 	if sandbox {
 		baseURL = asSandboxBaseURL
 	}
+	if o.baseURL != "" {
+		baseURL = o.baseURL
+	}
 	return &appStoreServer{
 		issuerID:     issuerID,
 		keyID:        keyID,
 		bundleID:     bundleID,
 		keyContent:   keyContent,
 		baseURL:      baseURL,
-		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		httpClient:   o.client(),
 		rootCertPool: appleRootCertPool(),
+		now:          o.now,
 	}
 }
 
@@ -100,12 +118,18 @@ type appStoreServerClaims struct {
 }
 
 func (s *appStoreServer) generateToken() (string, error) {
-	privateKey, err := parseECPrivateKey(s.keyContent)
-	if err != nil {
-		return "", err
+	signer := s.signer
+	if signer == nil {
+		var err error
+		if signer, err = NewPEMSigner(s.keyID, s.keyContent); err != nil {
+			return "", err
+		}
 	}
 
 	now := time.Now()
+	if s.now != nil {
+		now = s.now()
+	}
 	claims := appStoreServerClaims{
 		StandardClaims: jwt.StandardClaims{
 			Issuer:    s.issuerID,
@@ -116,11 +140,7 @@ func (s *appStoreServer) generateToken() (string, error) {
 		BundleID: s.bundleID,
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodES256, &claims)
-	token.Header["kid"] = s.keyID
-	token.Header["typ"] = "JWT"
-
-	return token.SignedString(privateKey)
+	return signJWT(signer, &claims, map[string]interface{}{"typ": "JWT"})
 }
 
 func (s *appStoreServer) doRequest(method, path string, queryParams url.Values, body, result any) error {
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/json"
 	"math/big"
@@ -33,9 +34,31 @@ type testCertChain struct {
 	rootDER         []byte
 }
 
+// testCertChainConfig changes the generated test cert chain.
+type testCertChainConfig struct {
+	omitLeafExtension         bool
+	omitIntermediateExtension bool
+	// leafNotBefore and leafNotAfter default to an hour ago and a day from now.
+	leafNotBefore time.Time
+	leafNotAfter  time.Time
+	// ocspServer is the OCSP responder of the leaf and intermediate.
+	ocspServer string
+}
+
+// appleMarkerExtension returns the Apple marker extension with oid.
+func appleMarkerExtension(oid asn1.ObjectIdentifier) pkix.Extension {
+	return pkix.Extension{Id: oid, Value: []byte{0x05, 0x00}} // ASN.1 NULL
+}
+
 // generateTestCertChain creates a root -> intermediate -> leaf cert chain for testing.
 func generateTestCertChain(t *testing.T) *testCertChain {
 	t.Helper()
+	return generateTestCertChainWith(t, testCertChainConfig{})
+}
+
+// generateTestCertChainWith creates a test cert chain changed by cfg.
+func generateTestCertChainWith(t *testing.T, cfg testCertChainConfig) *testCertChain {
+	t.Helper()
 
 	// Generate root CA
 	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -76,6 +99,12 @@ func generateTestCertChain(t *testing.T) *testCertChain {
 		BasicConstraintsValid: true,
 		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 	}
+	if cfg.ocspServer != "" {
+		intermediateTemplate.OCSPServer = []string{cfg.ocspServer}
+	}
+	if !cfg.omitIntermediateExtension {
+		intermediateTemplate.ExtraExtensions = []pkix.Extension{appleMarkerExtension(oidAppleWWDRIntermediate)}
+	}
 
 	intermediateDER, err := x509.CreateCertificate(rand.Reader, intermediateTemplate, rootCert, &intermediateKey.PublicKey, rootKey)
 	assert.NoError(t, err)
@@ -97,6 +126,18 @@ func generateTestCertChain(t *testing.T) *testCertChain {
 		NotAfter:  time.Now().Add(24 * time.Hour),
 		KeyUsage:  x509.KeyUsageDigitalSignature,
 	}
+	if !cfg.leafNotBefore.IsZero() {
+		leafTemplate.NotBefore = cfg.leafNotBefore
+	}
+	if !cfg.leafNotAfter.IsZero() {
+		leafTemplate.NotAfter = cfg.leafNotAfter
+	}
+	if cfg.ocspServer != "" {
+		leafTemplate.OCSPServer = []string{cfg.ocspServer}
+	}
+	if !cfg.omitLeafExtension {
+		leafTemplate.ExtraExtensions = []pkix.Extension{appleMarkerExtension(oidAppleReceiptSigning)}
+	}
 
 	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, intermediateCert, &leafKey.PublicKey, intermediateKey)
 	assert.NoError(t, err)
@@ -611,6 +652,62 @@ func TestParseV2_WithExternalPurchaseToken(t *testing.T) {
 	assert.Equal(t, int64(987654321), n.ExternalPurchaseToken.AppAppleID)
 }
 
+// --- Certificate Extension Tests ---
+
+func TestParseV2_MissingAppleExtensions(t *testing.T) {
+	for name, cfg := range map[string]testCertChainConfig{
+		"leaf":         {omitLeafExtension: true},
+		"intermediate": {omitIntermediateExtension: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			chain := generateTestCertChainWith(t, cfg)
+			as := newTestAppStore(chain.rootPool)
+
+			payload, _ := json.Marshal(ASNotificationV2{NotificationType: ASNotificationTypeTest})
+			envelope, _ := json.Marshal(ASSignedPayload{SignedPayload: createTestJWS(t, chain, payload)})
+
+			_, err := as.ParseV2(envelope)
+			var asErr *ASError
+			assert.ErrorAs(t, err, &asErr)
+			assert.Equal(t, ASErrorInvalidCertChain, asErr.Code)
+			assert.Contains(t, asErr.Reason, "Apple signing extensions")
+		})
+	}
+}
+
+// --- Signed Date Validation Tests ---
+
+func TestParseV2_SignedDateValidation(t *testing.T) {
+	now := time.Now()
+	// The leaf expired, but was valid when the notification was signed.
+	chain := generateTestCertChainWith(t, testCertChainConfig{
+		leafNotBefore: now.Add(-50 * time.Minute),
+		leafNotAfter:  now.Add(-30 * time.Minute),
+	})
+
+	envelope := func(signedDate time.Time) []byte {
+		payload, _ := json.Marshal(ASNotificationV2{NotificationType: ASNotificationTypeTest, SignedDate: signedDate.UnixMilli()})
+		body, _ := json.Marshal(ASSignedPayload{SignedPayload: createTestJWS(t, chain, payload)})
+		return body
+	}
+
+	_, err := newTestAppStore(chain.rootPool).ParseV2(envelope(now.Add(-40 * time.Minute)))
+	var asErr *ASError
+	assert.ErrorAs(t, err, &asErr)
+	assert.Equal(t, ASErrorInvalidCertChain, asErr.Code)
+
+	as := newAppStoreNotifications([]ASVerifierOption{WithSignedDateValidation()})
+	as.rootCertPool = chain.rootPool
+	n, err := as.ParseV2(envelope(now.Add(-40 * time.Minute)))
+	assert.NoError(t, err)
+	assert.Equal(t, ASNotificationTypeTest, n.NotificationType)
+
+	// A payload signed after the leaf expired is still rejected.
+	_, err = as.ParseV2(envelope(now.Add(-10 * time.Minute)))
+	assert.ErrorAs(t, err, &asErr)
+	assert.Equal(t, ASErrorInvalidCertChain, asErr.Code)
+}
+
 // --- Certificate Pool Test ---
 
 func TestAppleRootCertPool(t *testing.T) {
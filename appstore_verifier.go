@@ -0,0 +1,154 @@
+package apple
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SignedDataVerifier is an AppStoreNotifications that, on top of the
+// signature and certificate chain, checks that every payload belongs to the
+// configured app and environment. Use it instead of NewAppStoreNotifications
+// so that e.g. a sandbox notification is rejected by a production server.
+// A SignedDataVerifier is safe for concurrent use.
+type SignedDataVerifier struct {
+	bundleID      string
+	appAppleID    int64
+	environment   ASEnvironment
+	notifications *appStoreNotifications
+}
+
+// NewSignedDataVerifier creates a SignedDataVerifier for the app with the
+// given bundle ID and App Apple ID in environment. The App Apple ID is
+// required and checked in production only; in the sandbox it is ignored.
+func NewSignedDataVerifier(bundleID string, appAppleID int64, environment ASEnvironment, opts ...ASVerifierOption) (*SignedDataVerifier, error) {
+	if bundleID == "" {
+		return nil, errors.New("missing bundle id")
+	}
+	switch environment {
+	case ASEnvironmentProduction:
+		if appAppleID == 0 {
+			return nil, errors.New("missing app apple id for production")
+		}
+	case ASEnvironmentSandbox:
+	default:
+		return nil, fmt.Errorf("unknown environment: %q", environment)
+	}
+	return &SignedDataVerifier{
+		bundleID:      bundleID,
+		appAppleID:    appAppleID,
+		environment:   environment,
+		notifications: newAppStoreNotifications(opts),
+	}, nil
+}
+
+// ParseV1 parses a V1 App Store Server Notification. V1 notifications are
+// not signed and are not checked.
+func (v *SignedDataVerifier) ParseV1(payload []byte) (*ASNotificationV1, error) {
+	return v.notifications.ParseV1(payload)
+}
+
+// ParseV2 parses and verifies a V2 App Store Server Notification and checks
+// its data, summary or external purchase token.
+func (v *SignedDataVerifier) ParseV2(payload []byte) (*ASNotificationV2, error) {
+	return v.parseV2(context.Background(), payload)
+}
+
+func (v *SignedDataVerifier) parseV2(ctx context.Context, payload []byte) (*ASNotificationV2, error) {
+	n, err := v.notifications.parseV2(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case n.Data != nil:
+		err = v.check(n.Data.BundleID, n.Data.AppAppleID, n.Data.Environment)
+	case n.Summary != nil:
+		err = v.check(n.Summary.BundleID, n.Summary.AppAppleID, n.Summary.Environment)
+	case n.ExternalPurchaseToken != nil:
+		err = v.checkExternalPurchaseToken(n.ExternalPurchaseToken)
+	default:
+		err = &ASError{Code: ASErrorInvalidPayload, Reason: "notification has no data, summary or external purchase token"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// DecodeTransactionInfo decodes and verifies a signed transaction info JWS
+// string and checks its bundle ID and environment.
+func (v *SignedDataVerifier) DecodeTransactionInfo(signedTransactionInfo string) (*ASTransactionInfo, error) {
+	return v.decodeTransactionInfo(context.Background(), signedTransactionInfo)
+}
+
+func (v *SignedDataVerifier) decodeTransactionInfo(ctx context.Context, signedTransactionInfo string) (*ASTransactionInfo, error) {
+	txn, err := v.notifications.decodeTransactionInfo(ctx, signedTransactionInfo)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.checkBundleID(txn.BundleID); err != nil {
+		return nil, err
+	}
+	if err := v.checkEnvironment(txn.Environment); err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+// DecodeRenewalInfo decodes and verifies a signed renewal info JWS string
+// and checks its environment.
+func (v *SignedDataVerifier) DecodeRenewalInfo(signedRenewalInfo string) (*ASRenewalInfo, error) {
+	return v.decodeRenewalInfo(context.Background(), signedRenewalInfo)
+}
+
+func (v *SignedDataVerifier) decodeRenewalInfo(ctx context.Context, signedRenewalInfo string) (*ASRenewalInfo, error) {
+	renewal, err := v.notifications.decodeRenewalInfo(ctx, signedRenewalInfo)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.checkEnvironment(renewal.Environment); err != nil {
+		return nil, err
+	}
+	return renewal, nil
+}
+
+// checkExternalPurchaseToken checks an external purchase token. Tokens
+// without an environment are sandbox tokens if their ID has the SANDBOX
+// prefix.
+func (v *SignedDataVerifier) checkExternalPurchaseToken(t *ASExternalPurchaseToken) error {
+	environment := t.Environment
+	if environment == "" {
+		environment = ASEnvironmentProduction
+		if strings.HasPrefix(t.ExternalPurchaseID, "SANDBOX") {
+			environment = ASEnvironmentSandbox
+		}
+	}
+	return v.check(t.BundleID, t.AppAppleID, environment)
+}
+
+func (v *SignedDataVerifier) check(bundleID string, appAppleID int64, environment ASEnvironment) error {
+	if err := v.checkBundleID(bundleID); err != nil {
+		return err
+	}
+	// Apple leaves appAppleId out of sandbox payloads.
+	if v.environment == ASEnvironmentProduction && appAppleID != v.appAppleID {
+		return &ASError{Code: ASErrorInvalidAppAppleID, Reason: fmt.Sprintf("expected %d, got %d", v.appAppleID, appAppleID)}
+	}
+	return v.checkEnvironment(environment)
+}
+
+func (v *SignedDataVerifier) checkBundleID(bundleID string) error {
+	if bundleID != v.bundleID {
+		return &ASError{Code: ASErrorInvalidBundleID, Reason: fmt.Sprintf("expected %q, got %q", v.bundleID, bundleID)}
+	}
+	return nil
+}
+
+func (v *SignedDataVerifier) checkEnvironment(environment ASEnvironment) error {
+	if environment != v.environment {
+		return &ASError{Code: ASErrorInvalidEnvironment, Reason: fmt.Sprintf("expected %q, got %q", v.environment, environment)}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package apple
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSignedDataVerifier(t *testing.T, pool *x509.CertPool, environment ASEnvironment) *SignedDataVerifier {
+	v, err := NewSignedDataVerifier("com.example.app", 123456789, environment)
+	assert.NoError(t, err)
+	v.notifications = newTestAppStore(pool)
+	return v
+}
+
+func signedNotification(t *testing.T, chain *testCertChain, n ASNotificationV2) []byte {
+	payload, err := json.Marshal(n)
+	assert.NoError(t, err)
+	body, err := json.Marshal(ASSignedPayload{SignedPayload: createTestJWS(t, chain, payload)})
+	assert.NoError(t, err)
+	return body
+}
+
+func assertASErrorCode(t *testing.T, err error, code ASErrorCode) {
+	t.Helper()
+	var asErr *ASError
+	if assert.ErrorAs(t, err, &asErr) {
+		assert.Equal(t, code, asErr.Code)
+	}
+}
+
+func TestNewSignedDataVerifier(t *testing.T) {
+	_, err := NewSignedDataVerifier("", 1, ASEnvironmentProduction)
+	assert.Error(t, err)
+	_, err = NewSignedDataVerifier("com.example.app", 0, ASEnvironmentProduction)
+	assert.Error(t, err)
+	_, err = NewSignedDataVerifier("com.example.app", 0, "Xcode")
+	assert.Error(t, err)
+
+	v, err := NewSignedDataVerifier("com.example.app", 0, ASEnvironmentSandbox)
+	assert.NoError(t, err)
+	var _ AppStoreNotifications = v
+}
+
+func TestSignedDataVerifierParseV2(t *testing.T) {
+	chain := generateTestCertChain(t)
+	v := newTestSignedDataVerifier(t, chain.rootPool, ASEnvironmentProduction)
+
+	data := func(bundleID string, appAppleID int64, environment ASEnvironment) ASNotificationV2 {
+		return ASNotificationV2{
+			NotificationType: ASNotificationTypeDidRenew,
+			Data:             &ASNotificationData{BundleID: bundleID, AppAppleID: appAppleID, Environment: environment},
+		}
+	}
+
+	n, err := v.ParseV2(signedNotification(t, chain, data("com.example.app", 123456789, ASEnvironmentProduction)))
+	assert.NoError(t, err)
+	assert.Equal(t, ASNotificationTypeDidRenew, n.NotificationType)
+
+	_, err = v.ParseV2(signedNotification(t, chain, data("com.other.app", 123456789, ASEnvironmentProduction)))
+	assertASErrorCode(t, err, ASErrorInvalidBundleID)
+	_, err = v.ParseV2(signedNotification(t, chain, data("com.example.app", 987654321, ASEnvironmentProduction)))
+	assertASErrorCode(t, err, ASErrorInvalidAppAppleID)
+	_, err = v.ParseV2(signedNotification(t, chain, data("com.example.app", 123456789, ASEnvironmentSandbox)))
+	assertASErrorCode(t, err, ASErrorInvalidEnvironment)
+
+	// Summaries and external purchase tokens are checked the same way.
+	_, err = v.ParseV2(signedNotification(t, chain, ASNotificationV2{
+		NotificationType: ASNotificationTypeRenewalExtension,
+		Summary:          &ASNotificationSummary{BundleID: "com.example.app", AppAppleID: 123456789, Environment: ASEnvironmentSandbox},
+	}))
+	assertASErrorCode(t, err, ASErrorInvalidEnvironment)
+
+	_, err = v.ParseV2(signedNotification(t, chain, ASNotificationV2{
+		NotificationType:      ASNotificationTypeExternalPurchaseToken,
+		ExternalPurchaseToken: &ASExternalPurchaseToken{ExternalPurchaseID: "ext-1", BundleID: "com.example.app", AppAppleID: 123456789},
+	}))
+	assert.NoError(t, err)
+	_, err = v.ParseV2(signedNotification(t, chain, ASNotificationV2{
+		NotificationType:      ASNotificationTypeExternalPurchaseToken,
+		ExternalPurchaseToken: &ASExternalPurchaseToken{ExternalPurchaseID: "SANDBOX_ext-1", BundleID: "com.example.app", AppAppleID: 123456789},
+	}))
+	assertASErrorCode(t, err, ASErrorInvalidEnvironment)
+
+	_, err = v.ParseV2(signedNotification(t, chain, ASNotificationV2{NotificationType: ASNotificationTypeTest}))
+	assertASErrorCode(t, err, ASErrorInvalidPayload)
+}
+
+func TestSignedDataVerifierSandboxAppAppleID(t *testing.T) {
+	chain := generateTestCertChain(t)
+	sandboxData := func(appAppleID int64) []byte {
+		return signedNotification(t, chain, ASNotificationV2{
+			NotificationType: ASNotificationTypeTest,
+			Data:             &ASNotificationData{BundleID: "com.example.app", AppAppleID: appAppleID, Environment: ASEnvironmentSandbox},
+		})
+	}
+
+	v, err := NewSignedDataVerifier("com.example.app", 0, ASEnvironmentSandbox)
+	assert.NoError(t, err)
+	v.notifications = newTestAppStore(chain.rootPool)
+	_, err = v.ParseV2(sandboxData(555))
+	assert.NoError(t, err)
+
+	// Apple leaves appAppleId out of sandbox payloads, so a configured ID is
+	// not checked there.
+	v = newTestSignedDataVerifier(t, chain.rootPool, ASEnvironmentSandbox)
+	_, err = v.ParseV2(sandboxData(0))
+	assert.NoError(t, err)
+}
+
+func TestSignedDataVerifierDecode(t *testing.T) {
+	chain := generateTestCertChain(t)
+	v := newTestSignedDataVerifier(t, chain.rootPool, ASEnvironmentProduction)
+
+	sign := func(v interface{}) string {
+		payload, err := json.Marshal(v)
+		assert.NoError(t, err)
+		return createTestJWS(t, chain, payload)
+	}
+
+	txn, err := v.DecodeTransactionInfo(sign(ASTransactionInfo{TransactionID: "txn-1", BundleID: "com.example.app", Environment: ASEnvironmentProduction}))
+	assert.NoError(t, err)
+	assert.Equal(t, "txn-1", txn.TransactionID)
+	_, err = v.DecodeTransactionInfo(sign(ASTransactionInfo{BundleID: "com.other.app", Environment: ASEnvironmentProduction}))
+	assertASErrorCode(t, err, ASErrorInvalidBundleID)
+	_, err = v.DecodeTransactionInfo(sign(ASTransactionInfo{BundleID: "com.example.app", Environment: ASEnvironmentSandbox}))
+	assertASErrorCode(t, err, ASErrorInvalidEnvironment)
+
+	_, err = v.DecodeRenewalInfo(sign(ASRenewalInfo{Environment: ASEnvironmentProduction}))
+	assert.NoError(t, err)
+	_, err = v.DecodeRenewalInfo(sign(ASRenewalInfo{Environment: ASEnvironmentSandbox}))
+	assertASErrorCode(t, err, ASErrorInvalidEnvironment)
+}
@@ -3,24 +3,37 @@
 package apple
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
-	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
 const (
-	validationEndpoint = "https://appleid.apple.com/auth/token"
+	appleIDBaseURL     = "https://appleid.apple.com"
+	validationEndpoint = appleIDBaseURL + "/auth/token"
+	revokeEndpoint     = appleIDBaseURL + "/auth/revoke"
 	appleAudience      = "https://appleid.apple.com"
+
+	// maxClientSecretLifetime is the longest client secret lifetime Apple
+	// accepts, just under six months.
+	maxClientSecretLifetime = 15776999 * time.Second
+
+	// maxErrorBodyLength is how much of an error response body is kept.
+	maxErrorBodyLength = 1024
 )
 
 // AppleAuth is the contract for communication and validation of
@@ -29,18 +42,51 @@ type AppleAuth interface {
 	// ValidateCode validates an authorization code returning refresh token,
 	// access token and token id.
 	ValidateCode(code string) (*TokenResponse, error)
+	ValidateCodeContext(ctx context.Context, code string) (*TokenResponse, error)
 
 	// ValidateCode validates an authorization code with a redirect uri returning
 	// refresh token, access token and token id.
 	ValidateCodeWithRedirectURI(code, redirectURI string) (*TokenResponse, error)
+	ValidateCodeWithRedirectURIContext(ctx context.Context, code, redirectURI string) (*TokenResponse, error)
 
 	// ValidateRefreshToken validates a refresh token returning refresh token, access
 	// token and token id.
 	ValidateRefreshToken(refreshToken string) (*TokenResponse, error)
+	ValidateRefreshTokenContext(ctx context.Context, refreshToken string) (*TokenResponse, error)
+
+	// RevokeToken invalidates a refresh token or access token, as required
+	// when a user deletes their account.
+	RevokeToken(token string, tokenTypeHint TokenTypeHint) error
+	RevokeTokenContext(ctx context.Context, token string, tokenTypeHint TokenTypeHint) error
+
+	// RevokeTokens revokes every token with a single client secret. It keeps
+	// going when a revocation fails and returns the joined errors.
+	RevokeTokens(tokens []string, tokenTypeHint TokenTypeHint) error
+	RevokeTokensContext(ctx context.Context, tokens []string, tokenTypeHint TokenTypeHint) error
+
+	// ClientSecret returns the cached signed client secret, so other services
+	// can authenticate against Apple with the same secret.
+	ClientSecret() (string, error)
+
+	// TransferSub generates the transfer identifier of a user for a team
+	// transfer to targetTeamID.
+	TransferSub(sub, targetTeamID string) (string, error)
+	TransferSubContext(ctx context.Context, sub, targetTeamID string) (string, error)
+
+	// ExchangeTransferSub exchanges a transfer identifier for the user's sub
+	// under the receiving team.
+	ExchangeTransferSub(transferSub string) (*UserMigrationInfo, error)
+	ExchangeTransferSubContext(ctx context.Context, transferSub string) (*UserMigrationInfo, error)
+
+	// ClientCredentialsToken requests an app-level access token for scopes.
+	// Use a TokenSource to reuse it until it expires.
+	ClientCredentialsToken(scopes ...string) (*TokenResponse, error)
+	ClientCredentialsTokenContext(ctx context.Context, scopes ...string) (*TokenResponse, error)
 }
 
 type appleErrorResponseBody struct {
-	Error string `json:"error"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
 }
 
 // TokenResponse response when validation was successfull.
@@ -60,7 +106,7 @@ type TokenResponse struct {
 }
 
 type httpClient interface {
-	PostForm(url string, data url.Values) (resp *http.Response, err error)
+	Do(req *http.Request) (*http.Response, error)
 }
 
 type appleAuth struct {
@@ -68,40 +114,52 @@ type appleAuth struct {
 	TeamID     string
 	KeyID      string
 	KeyContent []byte
-	httpClient httpClient
+	// ClientSecretLifetime is how long a generated client secret is valid.
+	// Defaults to, and is capped at, Apple's maximum of six months.
+	ClientSecretLifetime time.Duration
+	httpClient           httpClient
+	baseURL              string
+	now                  func() time.Time
+
+	mu              sync.Mutex
+	signer          Signer
+	secret          string
+	secretExpiresAt time.Time
+
+	tokenMu         sync.Mutex
+	migrationTokens *TokenSource
 }
 
 // Setup and return a new AppleAuth for validation of tokens.
-func New(appID, teamID, keyID, keyPath string) (*appleAuth, error) {
+func New(appID, teamID, keyID, keyPath string, opts ...Option) (*appleAuth, error) {
 	keyContent, err := os.ReadFile(keyPath)
 	if err != nil {
 		return nil, err
 	}
-	return &appleAuth{
-		KeyID:      keyID,
-		TeamID:     teamID,
-		AppID:      appID,
-		KeyContent: keyContent,
-		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
-		},
-	}, nil
+	return newAppleAuth(appID, teamID, keyID, keyContent, nil, opts), nil
 }
 
 // Base64 key format if the key is an env variable: "base64 -i AuthKey_ABCDE12345.p8"
-func NewB64(appID, teamID, keyID, b64 string) (*appleAuth, error) {
+func NewB64(appID, teamID, keyID, b64 string, opts ...Option) (*appleAuth, error) {
 	keyContent, err := base64.StdEncoding.DecodeString(b64)
 	if err != nil {
 		return nil, err
 	}
+	return newAppleAuth(appID, teamID, keyID, keyContent, nil, opts), nil
+}
 
+func newAppleAuth(appID, teamID, keyID string, keyContent []byte, signer Signer, opts []Option) *appleAuth {
+	o := newClientOptions(10*time.Second, opts)
 	return &appleAuth{
 		KeyID:      keyID,
 		TeamID:     teamID,
 		AppID:      appID,
 		KeyContent: keyContent,
-		httpClient: &http.Client{Timeout: 10 * time.Second},
-	}, nil
+		httpClient: o.client(),
+		baseURL:    o.baseURL,
+		now:        o.now,
+		signer:     signer,
+	}
 }
 
 func parseECPrivateKey(keyContent []byte) (*ecdsa.PrivateKey, error) {
@@ -114,89 +172,173 @@ func parseECPrivateKey(keyContent []byte) (*ecdsa.PrivateKey, error) {
 	if err != nil {
 		return nil, err
 	}
-	return privateKey.(*ecdsa.PrivateKey), nil
+	ecKey, ok := privateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// NewWithSigner sets up a new AppleAuth that signs client secrets with
+// signer instead of a key file, e.g. with a key held in a KMS.
+func NewWithSigner(appID, teamID string, signer Signer, opts ...Option) (*appleAuth, error) {
+	if signer == nil {
+		return nil, errNilSigner
+	}
+	return newAppleAuth(appID, teamID, signer.KeyID(), nil, signer, opts), nil
+}
+
+// clock returns the current time of the configured clock.
+func (a *appleAuth) clock() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
+
+// endpoint returns the Apple endpoint on the configured base URL.
+func (a *appleAuth) endpoint(endpoint string) string {
+	return rebaseURL(endpoint, appleIDBaseURL, a.baseURL)
+}
+
+// keySigner returns the signer, parsing KeyContent on first use when none
+// was given. It must be called with a.mu held.
+func (a *appleAuth) keySigner() (Signer, error) {
+	if a.signer != nil {
+		return a.signer, nil
+	}
+	signer, err := NewPEMSigner(a.KeyID, a.KeyContent)
+	if err != nil {
+		return nil, err
+	}
+	a.signer = signer
+	return signer, nil
 }
 
-func (a *appleAuth) parsePrivateKey() (*ecdsa.PrivateKey, error) {
-	return parseECPrivateKey(a.KeyContent)
+// ClientSecret returns the signed client secret used to authenticate against
+// Apple's token endpoints. The secret is cached and replaced with a new one
+// shortly before it expires.
+func (a *appleAuth) ClientSecret() (string, error) {
+	return a.clientSecret()
 }
 
 func (a *appleAuth) clientSecret() (string, error) {
-	privateKey, err := a.parsePrivateKey()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	lifetime := a.ClientSecretLifetime
+	if lifetime <= 0 || lifetime > maxClientSecretLifetime {
+		lifetime = maxClientSecretLifetime
+	}
+
+	// Rotate once less than a tenth of the lifetime is left so that a secret
+	// never expires while a request is in flight.
+	now := a.clock()
+	if a.secret != "" && now.Before(a.secretExpiresAt.Add(-lifetime/10)) {
+		return a.secret, nil
+	}
+
+	signer, err := a.keySigner()
 	if err != nil {
 		return "", err
 	}
 
-	now := time.Now()
+	expiresAt := now.Add(lifetime)
 	claims := jwt.StandardClaims{
 		IssuedAt:  now.Unix(),
-		ExpiresAt: now.Add(time.Second * 15776999).Unix(),
+		ExpiresAt: expiresAt.Unix(),
 		Issuer:    a.TeamID,
 		Subject:   a.AppID,
 		Audience:  appleAudience,
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodES256, &claims)
-	token.Header["alg"] = "ES256"
-	token.Header["kid"] = a.KeyID
+	secret, err := signJWT(signer, &claims, nil)
+	if err != nil {
+		return "", err
+	}
 
-	return token.SignedString(privateKey)
+	a.secret = secret
+	a.secretExpiresAt = expiresAt
+	return secret, nil
 }
 
 func (a *appleAuth) ValidateCode(code string) (*TokenResponse, error) {
+	return a.ValidateCodeContext(context.Background(), code)
+}
+
+func (a *appleAuth) ValidateCodeContext(ctx context.Context, code string) (*TokenResponse, error) {
 	clientSecret, err := a.clientSecret()
 	if err != nil {
 		return nil, err
 	}
-	return a.validateCode(clientSecret, code)
+	return a.validateCode(ctx, clientSecret, code)
 }
 
-func (a *appleAuth) validateCode(clientSecret, code string) (*TokenResponse, error) {
+func (a *appleAuth) validateCode(ctx context.Context, clientSecret, code string) (*TokenResponse, error) {
 	formQuery := make(url.Values)
 	formQuery.Add("client_id", a.AppID)
 	formQuery.Add("client_secret", clientSecret)
 	formQuery.Add("code", code)
 	formQuery.Add("grant_type", "authorization_code")
-	return a.validateRequest(formQuery)
+	return a.validateRequest(ctx, formQuery)
 }
 
 func (a *appleAuth) ValidateCodeWithRedirectURI(code, redirectURI string) (*TokenResponse, error) {
+	return a.ValidateCodeWithRedirectURIContext(context.Background(), code, redirectURI)
+}
+
+func (a *appleAuth) ValidateCodeWithRedirectURIContext(ctx context.Context, code, redirectURI string) (*TokenResponse, error) {
 	clientSecret, err := a.clientSecret()
 	if err != nil {
 		return nil, err
 	}
-	return a.validateCodeWithRedirectURI(clientSecret, code, redirectURI)
+	return a.validateCodeWithRedirectURI(ctx, clientSecret, code, redirectURI)
 }
 
-func (a *appleAuth) validateCodeWithRedirectURI(clientSecret, code, redirectURI string) (*TokenResponse, error) {
+func (a *appleAuth) validateCodeWithRedirectURI(ctx context.Context, clientSecret, code, redirectURI string) (*TokenResponse, error) {
 	formQuery := make(url.Values)
 	formQuery.Add("client_id", a.AppID)
 	formQuery.Add("client_secret", clientSecret)
 	formQuery.Add("code", code)
 	formQuery.Add("grant_type", "authorization_code")
 	formQuery.Add("redirect_uri", redirectURI)
-	return a.validateRequest(formQuery)
+	return a.validateRequest(ctx, formQuery)
 }
 
 func (a *appleAuth) ValidateRefreshToken(refreshToken string) (*TokenResponse, error) {
+	return a.ValidateRefreshTokenContext(context.Background(), refreshToken)
+}
+
+func (a *appleAuth) ValidateRefreshTokenContext(ctx context.Context, refreshToken string) (*TokenResponse, error) {
 	clientSecret, err := a.clientSecret()
 	if err != nil {
 		return nil, err
 	}
-	return a.validateRefreshToken(clientSecret, refreshToken)
+	return a.validateRefreshToken(ctx, clientSecret, refreshToken)
 }
 
-func (a *appleAuth) validateRefreshToken(clientSecret, refreshToken string) (*TokenResponse, error) {
+func (a *appleAuth) validateRefreshToken(ctx context.Context, clientSecret, refreshToken string) (*TokenResponse, error) {
 	formQuery := make(url.Values)
 	formQuery.Add("client_id", a.AppID)
 	formQuery.Add("client_secret", clientSecret)
 	formQuery.Add("refresh_token", refreshToken)
 	formQuery.Add("grant_type", "refresh_token")
-	return a.validateRequest(formQuery)
+	return a.validateRequest(ctx, formQuery)
 }
 
-func (a *appleAuth) validateRequest(formQuery url.Values) (*TokenResponse, error) {
-	res, err := a.httpClient.PostForm(validationEndpoint, formQuery)
+// postForm sends the form to the given endpoint as a POST request bound to ctx.
+func (a *appleAuth) postForm(ctx context.Context, endpoint string, formQuery url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", a.endpoint(endpoint), strings.NewReader(formQuery.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	return a.httpClient.Do(req)
+}
+
+func (a *appleAuth) validateRequest(ctx context.Context, formQuery url.Values) (*TokenResponse, error) {
+	res, err := a.postForm(ctx, validationEndpoint, formQuery)
 	if err != nil {
 		return nil, err
 	}
@@ -205,26 +347,7 @@ func (a *appleAuth) validateRequest(formQuery url.Values) (*TokenResponse, error
 	}()
 
 	if res.StatusCode != http.StatusOK {
-		var errorResponseBody appleErrorResponseBody
-		if err := json.NewDecoder(res.Body).Decode(&errorResponseBody); err != nil {
-			return nil, err
-		}
-		switch errorResponseBody.Error {
-		case string(ErrorResponseTypeInvalidScope):
-			return nil, ErrorResponseInvalidScope
-		case string(ErrorResponseTypeUnsupportedGrantType):
-			return nil, ErrorResponseUnsupportedGrantType
-		case string(ErrorResponseTypeUnauthorizedClient):
-			return nil, ErrorResponseUnauthorizedClient
-		case string(ErrorResponseTypeInvalidGrant):
-			return nil, ErrorResponseInvalidGrant
-		case string(ErrorResponseTypeInvalidClient):
-			return nil, ErrorResponseInvalidClient
-		case string(ErrorResponseTypeInvalidRequest):
-			return nil, ErrorResponseInvalidRequest
-		default:
-			return nil, fmt.Errorf("unrecognized response error: %s", errorResponseBody.Error)
-		}
+		return nil, decodeErrorResponse(res)
 	}
 
 	var tokenResponse TokenResponse
@@ -233,3 +356,30 @@ func (a *appleAuth) validateRequest(formQuery url.Values) (*TokenResponse, error
 	}
 	return &tokenResponse, nil
 }
+
+// decodeErrorResponse builds an *AuthAPIError from a failed request to one
+// of Apple's auth endpoints. Bodies that are not JSON, such as HTML error
+// pages, are kept in truncated form instead of failing to decode.
+func decodeErrorResponse(res *http.Response) error {
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxErrorBodyLength))
+	if err != nil {
+		return err
+	}
+
+	apiErr := &AuthAPIError{
+		HTTPStatus: res.StatusCode,
+		Body:       string(body),
+	}
+	if ra := res.Header.Get("Retry-After"); ra != "" {
+		if v, err := strconv.Atoi(ra); err == nil {
+			apiErr.RetryAfter = v
+		}
+	}
+
+	var errorResponseBody appleErrorResponseBody
+	if err := json.Unmarshal(body, &errorResponseBody); err == nil {
+		apiErr.Type = ErrorResponseType(errorResponseBody.Error)
+		apiErr.Description = errorResponseBody.ErrorDescription
+	}
+	return apiErr
+}
@@ -0,0 +1,188 @@
+package apple
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	userMigrationEndpoint = appleIDBaseURL + "/auth/usermigrationinfo"
+	userMigrationScope    = "user.migration"
+)
+
+// UserMigrationInfo is the result of a team transfer step. TransferSub is
+// set by TransferSub on the sending team; Sub, Email and IsPrivateEmail are
+// set by ExchangeTransferSub on the receiving team.
+type UserMigrationInfo struct {
+	TransferSub    string `json:"transfer_sub,omitempty"`
+	Sub            string `json:"sub,omitempty"`
+	Email          string `json:"email,omitempty"`
+	IsPrivateEmail bool   `json:"is_private_email,omitempty"`
+}
+
+// TransferSub generates the transfer identifier for a user of this team,
+// to be handed to the team identified by targetTeamID. Call it before the
+// app is transferred.
+func (a *appleAuth) TransferSub(sub, targetTeamID string) (string, error) {
+	return a.TransferSubContext(context.Background(), sub, targetTeamID)
+}
+
+// TransferSubContext is like TransferSub but binds the requests to ctx.
+func (a *appleAuth) TransferSubContext(ctx context.Context, sub, targetTeamID string) (string, error) {
+	formQuery := make(url.Values)
+	formQuery.Add("sub", sub)
+	formQuery.Add("target", targetTeamID)
+
+	info, err := a.userMigrationInfo(ctx, formQuery)
+	if err != nil {
+		return "", err
+	}
+	return info.TransferSub, nil
+}
+
+// ExchangeTransferSub exchanges a transfer identifier received from the
+// previous team for the user's sub under this team. Call it after the app
+// has been transferred.
+func (a *appleAuth) ExchangeTransferSub(transferSub string) (*UserMigrationInfo, error) {
+	return a.ExchangeTransferSubContext(context.Background(), transferSub)
+}
+
+// ExchangeTransferSubContext is like ExchangeTransferSub but binds the
+// requests to ctx.
+func (a *appleAuth) ExchangeTransferSubContext(ctx context.Context, transferSub string) (*UserMigrationInfo, error) {
+	formQuery := make(url.Values)
+	formQuery.Add("transfer_sub", transferSub)
+
+	info, err := a.userMigrationInfo(ctx, formQuery)
+	if err != nil {
+		return nil, err
+	}
+	info.TransferSub = transferSub
+	return info, nil
+}
+
+// userMigrationInfo calls auth/usermigrationinfo with the given form,
+// authenticated with the client secret and a user.migration access token.
+func (a *appleAuth) userMigrationInfo(ctx context.Context, formQuery url.Values) (*UserMigrationInfo, error) {
+	clientSecret, err := a.clientSecret()
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := a.migrationAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	formQuery.Add("client_id", a.AppID)
+	formQuery.Add("client_secret", clientSecret)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", a.endpoint(userMigrationEndpoint), strings.NewReader(formQuery.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	res, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, decodeErrorResponse(res)
+	}
+
+	var info UserMigrationInfo
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// migrationAccessToken returns a user.migration access token obtained with
+// the client credentials grant, reusing it until shortly before it expires.
+func (a *appleAuth) migrationAccessToken(ctx context.Context) (string, error) {
+	a.tokenMu.Lock()
+	if a.migrationTokens == nil {
+		a.migrationTokens = NewTokenSource(a, userMigrationScope)
+		a.migrationTokens.now = a.clock
+	}
+	tokens := a.migrationTokens
+	a.tokenMu.Unlock()
+
+	return tokens.Token(ctx)
+}
+
+// UserMigrationStore records the processed users of a batch migration so
+// that a failed run can be resumed.
+type UserMigrationStore interface {
+	// Load returns the recorded result for id, or nil if id has not been
+	// processed yet.
+	Load(ctx context.Context, id string) (*UserMigrationInfo, error)
+	// Save records the result for id.
+	Save(ctx context.Context, id string, info *UserMigrationInfo) error
+}
+
+// UserMigrationRunner migrates users in bulk during a team transfer. Every
+// result is saved to Store as soon as it is received, and users already in
+// Store are skipped, so a run that stopped on an error can simply be
+// started again with the same input.
+type UserMigrationRunner struct {
+	Auth  AppleAuth
+	Store UserMigrationStore
+}
+
+// TransferAll generates transfer identifiers for subs on the sending team.
+// Results are stored under the sub.
+func (r *UserMigrationRunner) TransferAll(ctx context.Context, subs []string, targetTeamID string) error {
+	return r.run(ctx, subs, func(sub string) (*UserMigrationInfo, error) {
+		transferSub, err := r.Auth.TransferSubContext(ctx, sub, targetTeamID)
+		if err != nil {
+			return nil, err
+		}
+		return &UserMigrationInfo{Sub: sub, TransferSub: transferSub}, nil
+	})
+}
+
+// MigrateAll exchanges transfer identifiers for the users' subs on the
+// receiving team. Results are stored under the transfer identifier.
+func (r *UserMigrationRunner) MigrateAll(ctx context.Context, transferSubs []string) error {
+	return r.run(ctx, transferSubs, func(transferSub string) (*UserMigrationInfo, error) {
+		return r.Auth.ExchangeTransferSubContext(ctx, transferSub)
+	})
+}
+
+// run applies step to every id not yet in the store and stops at the first
+// failure.
+func (r *UserMigrationRunner) run(ctx context.Context, ids []string, step func(id string) (*UserMigrationInfo, error)) error {
+	for i, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		done, err := r.Store.Load(ctx, id)
+		if err != nil {
+			return fmt.Errorf("migrate user %d: %w", i, err)
+		}
+		if done != nil {
+			continue
+		}
+
+		info, err := step(id)
+		if err != nil {
+			return fmt.Errorf("migrate user %d: %w", i, err)
+		}
+		if err := r.Store.Save(ctx, id, info); err != nil {
+			return fmt.Errorf("migrate user %d: %w", i, err)
+		}
+	}
+	return nil
+}
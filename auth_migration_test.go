@@ -0,0 +1,132 @@
+package apple
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// memoryUserMigrationStore implements UserMigrationStore for testing.
+type memoryUserMigrationStore map[string]*UserMigrationInfo
+
+func (s memoryUserMigrationStore) Load(_ context.Context, id string) (*UserMigrationInfo, error) {
+	return s[id], nil
+}
+
+func (s memoryUserMigrationStore) Save(_ context.Context, id string, info *UserMigrationInfo) error {
+	s[id] = info
+	return nil
+}
+
+func jsonResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Body:       io.NopCloser(bytes.NewReader([]byte(body))),
+	}
+}
+
+// mockMigrationEndpoints answers the client credentials grant and the user
+// migration endpoint of the mocked client.
+func mockMigrationEndpoints(m *MockedHTTPClient) {
+	m.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+		form := requestForm(req)
+		return req.URL.String() == validationEndpoint &&
+			form.Get("grant_type") == "client_credentials" &&
+			form.Get("scope") == "user.migration"
+	})).Return(jsonResponse(200, `{"access_token":"migration-token","token_type":"bearer","expires_in":3600}`), nil).Once()
+
+	m.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+		form := requestForm(req)
+		return req.URL.String() == userMigrationEndpoint &&
+			req.Header.Get("Authorization") == "Bearer migration-token" &&
+			form.Get("client_id") == "com.example.app" &&
+			form.Get("sub") == "old-sub" && form.Get("target") == "NEWTEAM123"
+	})).Return(jsonResponse(200, `{"transfer_sub":"transfer-1"}`), nil)
+
+	m.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+		form := requestForm(req)
+		return req.URL.String() == userMigrationEndpoint &&
+			req.Header.Get("Authorization") == "Bearer migration-token" &&
+			form.Get("transfer_sub") == "transfer-1"
+	})).Return(jsonResponse(200, `{"sub":"new-sub","email":"abc@privaterelay.appleid.com","is_private_email":true}`), nil)
+
+	m.On("Do", mock.Anything).Return(jsonResponse(400, `{"error":"invalid_request"}`), nil)
+}
+
+func TestTransferSub(t *testing.T) {
+	mockedHTTPClient := new(MockedHTTPClient)
+	mockMigrationEndpoints(mockedHTTPClient)
+	auth := newTestAppleAuth(mockedHTTPClient)
+
+	transferSub, err := auth.TransferSub("old-sub", "NEWTEAM123")
+	assert.NoError(t, err)
+	assert.Equal(t, "transfer-1", transferSub)
+}
+
+func TestExchangeTransferSub(t *testing.T) {
+	mockedHTTPClient := new(MockedHTTPClient)
+	mockMigrationEndpoints(mockedHTTPClient)
+	auth := newTestAppleAuth(mockedHTTPClient)
+
+	info, err := auth.ExchangeTransferSub("transfer-1")
+	assert.NoError(t, err)
+	assert.Equal(t, &UserMigrationInfo{
+		TransferSub:    "transfer-1",
+		Sub:            "new-sub",
+		Email:          "abc@privaterelay.appleid.com",
+		IsPrivateEmail: true,
+	}, info)
+}
+
+func TestExchangeTransferSubError(t *testing.T) {
+	mockedHTTPClient := new(MockedHTTPClient)
+	mockMigrationEndpoints(mockedHTTPClient)
+	auth := newTestAppleAuth(mockedHTTPClient)
+
+	_, err := auth.ExchangeTransferSub("unknown")
+	assert.ErrorIs(t, err, ErrorResponseInvalidRequest)
+}
+
+func TestUserMigrationRunnerResume(t *testing.T) {
+	mockedHTTPClient := new(MockedHTTPClient)
+	mockMigrationEndpoints(mockedHTTPClient)
+
+	store := memoryUserMigrationStore{}
+	runner := &UserMigrationRunner{Auth: newTestAppleAuth(mockedHTTPClient), Store: store}
+
+	// The second transfer identifier fails; the first one is kept.
+	err := runner.MigrateAll(context.Background(), []string{"transfer-1", "unknown"})
+	assert.ErrorIs(t, err, ErrorResponseInvalidRequest)
+	assert.Equal(t, "new-sub", store["transfer-1"].Sub)
+
+	// A resumed run skips users that were already migrated.
+	store["unknown"] = &UserMigrationInfo{}
+	err = runner.MigrateAll(context.Background(), []string{"transfer-1", "unknown"})
+	assert.NoError(t, err)
+
+	// The access token is fetched once and the exchange is not repeated.
+	calls := 0
+	for _, c := range mockedHTTPClient.Calls {
+		if requestForm(c.Arguments.Get(0).(*http.Request)).Get("transfer_sub") == "transfer-1" {
+			calls++
+		}
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestUserMigrationRunnerTransferAll(t *testing.T) {
+	mockedHTTPClient := new(MockedHTTPClient)
+	mockMigrationEndpoints(mockedHTTPClient)
+
+	store := memoryUserMigrationStore{}
+	runner := &UserMigrationRunner{Auth: newTestAppleAuth(mockedHTTPClient), Store: store}
+
+	err := runner.TransferAll(context.Background(), []string{"old-sub"}, "NEWTEAM123")
+	assert.NoError(t, err)
+	assert.Equal(t, &UserMigrationInfo{Sub: "old-sub", TransferSub: "transfer-1"}, store["old-sub"])
+}
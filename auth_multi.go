@@ -0,0 +1,107 @@
+package apple
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// MultiClientAuth validates tokens for several client IDs registered under
+// the same team key, e.g. an iOS bundle ID and a website Services ID. Each
+// client has its own AppleAuth with its own cached client secret.
+// A MultiClientAuth is safe for concurrent use.
+type MultiClientAuth struct {
+	clientIDs []string
+	clients   map[string]*appleAuth
+}
+
+// NewMultiClient sets up a MultiClientAuth for the given client IDs using a
+// key file path.
+func NewMultiClient(clientIDs []string, teamID, keyID, keyPath string, opts ...Option) (*MultiClientAuth, error) {
+	keyContent, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return newMultiClient(clientIDs, teamID, keyID, keyContent, opts)
+}
+
+// NewMultiClientB64 sets up a MultiClientAuth for the given client IDs using
+// a base64-encoded key.
+func NewMultiClientB64(clientIDs []string, teamID, keyID, b64 string, opts ...Option) (*MultiClientAuth, error) {
+	keyContent, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, err
+	}
+	return newMultiClient(clientIDs, teamID, keyID, keyContent, opts)
+}
+
+// NewMultiClientWithSigner sets up a MultiClientAuth for the given client
+// IDs that signs client secrets with signer.
+func NewMultiClientWithSigner(clientIDs []string, teamID string, signer Signer, opts ...Option) (*MultiClientAuth, error) {
+	if signer == nil {
+		return nil, errNilSigner
+	}
+	return newMultiClientWithSigner(clientIDs, teamID, signer, nil, opts)
+}
+
+func newMultiClient(clientIDs []string, teamID, keyID string, keyContent []byte, opts []Option) (*MultiClientAuth, error) {
+	// The key is parsed once and shared by every client.
+	signer, err := NewPEMSigner(keyID, keyContent)
+	if err != nil {
+		return nil, err
+	}
+	return newMultiClientWithSigner(clientIDs, teamID, signer, keyContent, opts)
+}
+
+func newMultiClientWithSigner(clientIDs []string, teamID string, signer Signer, keyContent []byte, opts []Option) (*MultiClientAuth, error) {
+	if len(clientIDs) == 0 {
+		return nil, errors.New("no client ids")
+	}
+
+	o := newClientOptions(10*time.Second, opts)
+	httpClient := o.client()
+	m := &MultiClientAuth{clients: make(map[string]*appleAuth, len(clientIDs))}
+	for _, clientID := range clientIDs {
+		if _, ok := m.clients[clientID]; ok {
+			continue
+		}
+		m.clientIDs = append(m.clientIDs, clientID)
+		m.clients[clientID] = &appleAuth{
+			AppID:      clientID,
+			TeamID:     teamID,
+			KeyID:      signer.KeyID(),
+			KeyContent: keyContent,
+			httpClient: httpClient,
+			baseURL:    o.baseURL,
+			now:        o.now,
+			signer:     signer,
+		}
+	}
+	return m, nil
+}
+
+// Client returns the AppleAuth for a registered client ID.
+func (m *MultiClientAuth) Client(clientID string) (AppleAuth, error) {
+	a, ok := m.clients[clientID]
+	if !ok {
+		return nil, fmt.Errorf("unregistered client id: %s", clientID)
+	}
+	return a, nil
+}
+
+// ClientIDs returns the registered client IDs in registration order.
+func (m *MultiClientAuth) ClientIDs() []string {
+	return append([]string(nil), m.clientIDs...)
+}
+
+// VerifyIDToken verifies the JWT id token like VerifyIDTokenWithOptions.
+// When opts has no audiences, any registered client ID is accepted. The
+// client the token was issued for is available as AppleUser.Audience.
+func (m *MultiClientAuth) VerifyIDToken(keys *KeySet, idToken string, opts IDTokenOptions) (*AppleUser, error) {
+	if len(opts.Audiences) == 0 {
+		opts.Audiences = m.clientIDs
+	}
+	return VerifyIDTokenWithOptions(keys, idToken, opts)
+}
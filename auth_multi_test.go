@@ -0,0 +1,84 @@
+package apple
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMultiClient(t *testing.T) *MultiClientAuth {
+	t.Helper()
+	m, err := NewMultiClientB64(
+		[]string{"com.example.app", "com.example.web", "com.example.app"},
+		"TEAM123456", "KEYID12345",
+		base64.StdEncoding.EncodeToString([]byte(testECPrivateKey)),
+	)
+	assert.NoError(t, err)
+	return m
+}
+
+func TestNewMultiClient(t *testing.T) {
+	m := newTestMultiClient(t)
+	assert.Equal(t, []string{"com.example.app", "com.example.web"}, m.ClientIDs())
+}
+
+func TestNewMultiClientErrors(t *testing.T) {
+	_, err := NewMultiClientB64(nil, "TEAM123456", "KEYID12345", base64.StdEncoding.EncodeToString([]byte(testECPrivateKey)))
+	assert.Error(t, err)
+
+	_, err = NewMultiClientB64([]string{"com.example.app"}, "TEAM123456", "KEYID12345", "aW52YWxpZA==")
+	assert.Error(t, err)
+
+	_, err = NewMultiClient([]string{"com.example.app"}, "TEAM123456", "KEYID12345", "/does/not/exist.p8")
+	assert.Error(t, err)
+}
+
+func TestMultiClientSecrets(t *testing.T) {
+	m := newTestMultiClient(t)
+
+	app, err := m.Client("com.example.app")
+	assert.NoError(t, err)
+	web, err := m.Client("com.example.web")
+	assert.NoError(t, err)
+
+	appSecret, err := app.ClientSecret()
+	assert.NoError(t, err)
+	webSecret, err := web.ClientSecret()
+	assert.NoError(t, err)
+	assert.NotEqual(t, appSecret, webSecret)
+
+	claims := &jwt.StandardClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(webSecret, claims)
+	assert.NoError(t, err)
+	assert.Equal(t, "com.example.web", claims.Subject)
+
+	// Each client caches its own secret.
+	again, err := web.ClientSecret()
+	assert.NoError(t, err)
+	assert.Equal(t, webSecret, again)
+
+	_, err = m.Client("com.example.other")
+	assert.Error(t, err)
+}
+
+func TestMultiClientVerifyIDToken(t *testing.T) {
+	m := newTestMultiClient(t)
+	srv := newTestJWKSServer(t, "kid1")
+	keys := NewKeySet(srv.server.URL)
+
+	for _, aud := range []string{"com.example.app", "com.example.web"} {
+		claims := testIDTokenClaims(time.Now())
+		claims["aud"] = aud
+		u, err := m.VerifyIDToken(keys, srv.sign(t, "kid1", claims), IDTokenOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, aud, u.Audience)
+	}
+
+	claims := testIDTokenClaims(time.Now())
+	claims["aud"] = "com.example.other"
+	_, err := m.VerifyIDToken(keys, srv.sign(t, "kid1", claims), IDTokenOptions{})
+	assertIDTokenError(t, err, IDTokenErrorInvalidAudience)
+}
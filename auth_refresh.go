@@ -0,0 +1,279 @@
+package apple
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRefreshValidateInterval = 24 * time.Hour
+	defaultRefreshCheckInterval    = time.Hour
+	defaultRefreshConcurrency      = 4
+)
+
+// RefreshTokenRecord is a refresh token tracked by a RefreshTokenManager.
+type RefreshTokenRecord struct {
+	Subject      string    `json:"sub"`
+	RefreshToken string    `json:"refresh_token"`
+	ValidatedAt  time.Time `json:"validated_at"`
+}
+
+// RefreshTokenStore persists the refresh tokens of a RefreshTokenManager.
+type RefreshTokenStore interface {
+	// Save creates or replaces the record of rec.Subject.
+	Save(ctx context.Context, rec *RefreshTokenRecord) error
+	// Load returns the record of subject, or nil if there is none.
+	Load(ctx context.Context, subject string) (*RefreshTokenRecord, error)
+	// Delete removes the record of subject. Deleting a missing record is not
+	// an error.
+	Delete(ctx context.Context, subject string) error
+	// Due returns the records last validated before t.
+	Due(ctx context.Context, t time.Time) ([]*RefreshTokenRecord, error)
+}
+
+// MemoryRefreshTokenStore is an in-memory RefreshTokenStore.
+// A MemoryRefreshTokenStore is safe for concurrent use.
+type MemoryRefreshTokenStore struct {
+	mu      sync.Mutex
+	records map[string]RefreshTokenRecord
+}
+
+// NewMemoryRefreshTokenStore creates an empty MemoryRefreshTokenStore.
+func NewMemoryRefreshTokenStore() *MemoryRefreshTokenStore {
+	return &MemoryRefreshTokenStore{records: make(map[string]RefreshTokenRecord)}
+}
+
+// Save implements RefreshTokenStore.
+func (s *MemoryRefreshTokenStore) Save(_ context.Context, rec *RefreshTokenRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[rec.Subject] = *rec
+	return nil
+}
+
+// Load implements RefreshTokenStore.
+func (s *MemoryRefreshTokenStore) Load(_ context.Context, subject string) (*RefreshTokenRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[subject]
+	if !ok {
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+// Delete implements RefreshTokenStore.
+func (s *MemoryRefreshTokenStore) Delete(_ context.Context, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, subject)
+	return nil
+}
+
+// Due implements RefreshTokenStore. Records are returned oldest first.
+func (s *MemoryRefreshTokenStore) Due(_ context.Context, t time.Time) ([]*RefreshTokenRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*RefreshTokenRecord
+	for _, rec := range s.records {
+		if rec.ValidatedAt.Before(t) {
+			rec := rec
+			due = append(due, &rec)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].ValidatedAt.Before(due[j].ValidatedAt)
+	})
+	return due, nil
+}
+
+// RefreshTokenManager keeps users' refresh tokens and re-validates them with
+// Apple to confirm their Apple ID sessions are still valid. Apple asks
+// clients to validate a refresh token at most once a day. A token Apple
+// rejects with invalid_grant is reported through OnRevoked and then removed
+// from Store; if OnRevoked fails, the token is kept and reported again on the
+// next pass. Other failures keep the token for the next pass.
+//
+// A token replaced by Track or removed by Forget while it is being
+// validated is left alone: the outcome of the validation is dropped. This
+// holds for calls on the same manager; managers sharing a Store across
+// processes must not validate the same subjects concurrently.
+type RefreshTokenManager struct {
+	// Auth validates the tokens. Required.
+	Auth AppleAuth
+	// Store persists the tokens. Required.
+	Store RefreshTokenStore
+
+	// Interval is how often each token is validated. Defaults to 24 hours.
+	Interval time.Duration
+	// CheckInterval is how often Run looks for due tokens. Defaults to one
+	// hour.
+	CheckInterval time.Duration
+	// Concurrency limits the validations in flight. Defaults to 4.
+	Concurrency int
+
+	// OnRevoked is called after a user's token was rejected by Apple, e.g.
+	// to end the user's sessions. The token is removed from Store only after
+	// OnRevoked returns nil.
+	OnRevoked func(ctx context.Context, rec *RefreshTokenRecord) error
+	// OnError is called when a token could not be validated for another
+	// reason. The token is retried on the next pass. Run also reports the
+	// errors of a whole pass here, with a nil rec.
+	OnError func(ctx context.Context, rec *RefreshTokenRecord, err error)
+
+	// mu serializes Track and Forget with the store updates of validate.
+	mu sync.Mutex
+}
+
+// Track starts managing refreshToken for subject, e.g. right after the
+// authorization code was exchanged. The token counts as validated now.
+func (m *RefreshTokenManager) Track(ctx context.Context, subject, refreshToken string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Store.Save(ctx, &RefreshTokenRecord{
+		Subject:      subject,
+		RefreshToken: refreshToken,
+		ValidatedAt:  time.Now(),
+	})
+}
+
+// Forget stops managing the token of subject, e.g. after the user signed
+// out or the token was revoked.
+func (m *RefreshTokenManager) Forget(ctx context.Context, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Store.Delete(ctx, subject)
+}
+
+// Run validates due tokens every CheckInterval until ctx is done. Errors of
+// a pass are reported through OnError and do not stop Run.
+func (m *RefreshTokenManager) Run(ctx context.Context) error {
+	checkInterval := m.CheckInterval
+	if checkInterval <= 0 {
+		checkInterval = defaultRefreshCheckInterval
+	}
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.ValidateDue(ctx); err != nil && m.OnError != nil && ctx.Err() == nil {
+			m.OnError(ctx, nil, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ValidateDue validates every token not validated within Interval, at most
+// Concurrency at a time. It returns the joined store and OnRevoked errors;
+// validation failures other than revocation go to OnError only.
+func (m *RefreshTokenManager) ValidateDue(ctx context.Context) error {
+	interval := m.Interval
+	if interval <= 0 {
+		interval = defaultRefreshValidateInterval
+	}
+	concurrency := m.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultRefreshConcurrency
+	}
+
+	due, err := m.Store.Due(ctx, time.Now().Add(-interval))
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+		sem  = make(chan struct{}, concurrency)
+	)
+	for _, rec := range due {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return errors.Join(append(errs, ctx.Err())...)
+		}
+
+		wg.Add(1)
+		go func(rec *RefreshTokenRecord) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := m.validate(ctx, rec); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("refresh token of %s: %w", rec.Subject, err))
+				mu.Unlock()
+			}
+		}(rec)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// validate checks a single token and updates the store with the outcome.
+func (m *RefreshTokenManager) validate(ctx context.Context, rec *RefreshTokenRecord) error {
+	_, err := m.Auth.ValidateRefreshTokenContext(ctx, rec.RefreshToken)
+	switch {
+	case err == nil:
+		rec.ValidatedAt = time.Now()
+		_, err := m.update(ctx, rec, func() error { return m.Store.Save(ctx, rec) })
+		return err
+	case errors.Is(err, ErrorResponseInvalidGrant):
+		// End the sessions before forgetting the token, so that a failing
+		// OnRevoked is retried on the next pass.
+		if m.OnRevoked != nil {
+			m.mu.Lock()
+			current, err := m.isCurrent(ctx, rec)
+			m.mu.Unlock()
+			if err != nil || !current {
+				return err
+			}
+			if err := m.OnRevoked(ctx, rec); err != nil {
+				return err
+			}
+		}
+		_, err := m.update(ctx, rec, func() error { return m.Store.Delete(ctx, rec.Subject) })
+		return err
+	default:
+		if m.OnError != nil && ctx.Err() == nil {
+			m.OnError(ctx, rec, err)
+		}
+		return nil
+	}
+}
+
+// update runs write unless the stored token of rec.Subject was replaced or
+// forgotten while rec was being validated. It reports whether write ran.
+func (m *RefreshTokenManager) update(ctx context.Context, rec *RefreshTokenRecord, write func() error) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, err := m.isCurrent(ctx, rec)
+	if err != nil || !current {
+		return false, err
+	}
+	return true, write()
+}
+
+// isCurrent reports whether rec still holds the stored token of its subject.
+// The caller holds m.mu.
+func (m *RefreshTokenManager) isCurrent(ctx context.Context, rec *RefreshTokenRecord) (bool, error) {
+	stored, err := m.Store.Load(ctx, rec.Subject)
+	if err != nil {
+		return false, err
+	}
+	return stored != nil && stored.RefreshToken == rec.RefreshToken, nil
+}
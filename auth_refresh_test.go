@@ -0,0 +1,220 @@
+package apple
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// refreshTokenClient answers refresh token grants by looking up the token in
+// responses and tracks the number of requests in flight. onRequest, if set,
+// is called with the token before answering.
+type refreshTokenClient struct {
+	responses map[string]int
+	delay     time.Duration
+	onRequest func(token string)
+
+	inFlight    atomic.Int32
+	maxInFlight atomic.Int32
+}
+
+func (c *refreshTokenClient) Do(req *http.Request) (*http.Response, error) {
+	n := c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
+	for {
+		max := c.maxInFlight.Load()
+		if n <= max || c.maxInFlight.CompareAndSwap(max, n) {
+			break
+		}
+	}
+	time.Sleep(c.delay)
+
+	token := requestForm(req).Get("refresh_token")
+	if c.onRequest != nil {
+		c.onRequest(token)
+	}
+	switch c.responses[token] {
+	case http.StatusOK:
+		return jsonResponse(http.StatusOK, `{"access_token":"access","token_type":"bearer","expires_in":3600}`), nil
+	case http.StatusBadRequest:
+		return jsonResponse(http.StatusBadRequest, `{"error":"invalid_grant"}`), nil
+	default:
+		return jsonResponse(http.StatusServiceUnavailable, ``), nil
+	}
+}
+
+func TestMemoryRefreshTokenStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryRefreshTokenStore()
+	now := time.Now()
+
+	assert.NoError(t, s.Save(ctx, &RefreshTokenRecord{Subject: "a", RefreshToken: "ta", ValidatedAt: now.Add(-2 * time.Hour)}))
+	assert.NoError(t, s.Save(ctx, &RefreshTokenRecord{Subject: "b", RefreshToken: "tb", ValidatedAt: now.Add(-3 * time.Hour)}))
+	assert.NoError(t, s.Save(ctx, &RefreshTokenRecord{Subject: "c", RefreshToken: "tc", ValidatedAt: now}))
+
+	rec, err := s.Load(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "ta", rec.RefreshToken)
+
+	due, err := s.Due(ctx, now.Add(-time.Hour))
+	assert.NoError(t, err)
+	if assert.Len(t, due, 2) {
+		assert.Equal(t, "b", due[0].Subject)
+		assert.Equal(t, "a", due[1].Subject)
+	}
+
+	assert.NoError(t, s.Delete(ctx, "a"))
+	rec, err = s.Load(ctx, "a")
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+}
+
+func TestRefreshTokenManagerValidateDue(t *testing.T) {
+	ctx := context.Background()
+	client := &refreshTokenClient{responses: map[string]int{
+		"valid":   http.StatusOK,
+		"revoked": http.StatusBadRequest,
+		"flaky":   http.StatusServiceUnavailable,
+	}}
+	store := NewMemoryRefreshTokenStore()
+
+	var (
+		mu      sync.Mutex
+		revoked []string
+		failed  []string
+	)
+	m := &RefreshTokenManager{
+		Auth:  newTestAppleAuth(client),
+		Store: store,
+		OnRevoked: func(ctx context.Context, rec *RefreshTokenRecord) error {
+			mu.Lock()
+			defer mu.Unlock()
+			revoked = append(revoked, rec.Subject)
+			return nil
+		},
+		OnError: func(ctx context.Context, rec *RefreshTokenRecord, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			failed = append(failed, rec.Subject)
+			assert.True(t, IsRetryable(err))
+		},
+	}
+
+	old := time.Now().Add(-25 * time.Hour)
+	for sub, token := range map[string]string{"u1": "valid", "u2": "revoked", "u3": "flaky"} {
+		assert.NoError(t, store.Save(ctx, &RefreshTokenRecord{Subject: sub, RefreshToken: token, ValidatedAt: old}))
+	}
+	assert.NoError(t, m.Track(ctx, "u4", "revoked"))
+
+	assert.NoError(t, m.ValidateDue(ctx))
+	assert.Equal(t, []string{"u2"}, revoked)
+	assert.Equal(t, []string{"u3"}, failed)
+
+	rec, _ := store.Load(ctx, "u1")
+	if assert.NotNil(t, rec) {
+		assert.WithinDuration(t, time.Now(), rec.ValidatedAt, time.Minute)
+	}
+	rec, _ = store.Load(ctx, "u2")
+	assert.Nil(t, rec)
+	rec, _ = store.Load(ctx, "u3")
+	if assert.NotNil(t, rec) {
+		assert.Equal(t, old.Unix(), rec.ValidatedAt.Unix())
+	}
+	// u4 was tracked just now and is not due yet.
+	rec, _ = store.Load(ctx, "u4")
+	assert.NotNil(t, rec)
+}
+
+func TestRefreshTokenManagerConcurrency(t *testing.T) {
+	ctx := context.Background()
+	client := &refreshTokenClient{responses: map[string]int{"valid": http.StatusOK}, delay: 20 * time.Millisecond}
+	store := NewMemoryRefreshTokenStore()
+	for _, sub := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		assert.NoError(t, store.Save(ctx, &RefreshTokenRecord{Subject: sub, RefreshToken: "valid"}))
+	}
+
+	m := &RefreshTokenManager{Auth: newTestAppleAuth(client), Store: store, Concurrency: 2}
+	assert.NoError(t, m.ValidateDue(ctx))
+	assert.Equal(t, int32(2), client.maxInFlight.Load())
+
+	due, _ := store.Due(ctx, time.Now().Add(-time.Hour))
+	assert.Empty(t, due)
+}
+
+func TestRefreshTokenManagerOnRevokedError(t *testing.T) {
+	ctx := context.Background()
+	client := &refreshTokenClient{responses: map[string]int{"revoked": http.StatusBadRequest}}
+	store := NewMemoryRefreshTokenStore()
+	assert.NoError(t, store.Save(ctx, &RefreshTokenRecord{Subject: "u1", RefreshToken: "revoked"}))
+
+	sessionErr := errors.New("session store unavailable")
+	calls := 0
+	m := &RefreshTokenManager{
+		Auth:  newTestAppleAuth(client),
+		Store: store,
+		OnRevoked: func(ctx context.Context, rec *RefreshTokenRecord) error {
+			calls++
+			if calls == 1 {
+				return sessionErr
+			}
+			return nil
+		},
+	}
+	assert.ErrorIs(t, m.ValidateDue(ctx), sessionErr)
+
+	// The token is kept so that the next pass reports it again.
+	rec, _ := store.Load(ctx, "u1")
+	assert.NotNil(t, rec)
+
+	assert.NoError(t, m.ValidateDue(ctx))
+	assert.Equal(t, 2, calls)
+	rec, _ = store.Load(ctx, "u1")
+	assert.Nil(t, rec)
+}
+
+func TestRefreshTokenManagerConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	client := &refreshTokenClient{responses: map[string]int{
+		"valid":   http.StatusOK,
+		"revoked": http.StatusBadRequest,
+	}}
+	store := NewMemoryRefreshTokenStore()
+	var revoked []string
+	m := &RefreshTokenManager{
+		Auth:  newTestAppleAuth(client),
+		Store: store,
+		OnRevoked: func(ctx context.Context, rec *RefreshTokenRecord) error {
+			revoked = append(revoked, rec.Subject)
+			return nil
+		},
+	}
+
+	// u1 signs in again and u2 signs out while their old tokens are checked.
+	client.onRequest = func(token string) {
+		switch token {
+		case "revoked":
+			assert.NoError(t, m.Track(ctx, "u1", "fresh"))
+		case "valid":
+			assert.NoError(t, m.Forget(ctx, "u2"))
+		}
+	}
+	old := time.Now().Add(-25 * time.Hour)
+	assert.NoError(t, store.Save(ctx, &RefreshTokenRecord{Subject: "u1", RefreshToken: "revoked", ValidatedAt: old}))
+	assert.NoError(t, store.Save(ctx, &RefreshTokenRecord{Subject: "u2", RefreshToken: "valid", ValidatedAt: old}))
+
+	assert.NoError(t, m.ValidateDue(ctx))
+	assert.Empty(t, revoked)
+
+	rec, _ := store.Load(ctx, "u1")
+	if assert.NotNil(t, rec) {
+		assert.Equal(t, "fresh", rec.RefreshToken)
+	}
+	rec, _ = store.Load(ctx, "u2")
+	assert.Nil(t, rec)
+}
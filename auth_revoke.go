@@ -0,0 +1,80 @@
+package apple
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// TokenTypeHint tells Apple which kind of token is being revoked.
+type TokenTypeHint string
+
+const (
+	TokenTypeHintRefreshToken TokenTypeHint = "refresh_token"
+	TokenTypeHintAccessToken  TokenTypeHint = "access_token"
+)
+
+// RevokeToken invalidates a refresh token or access token.
+func (a *appleAuth) RevokeToken(token string, tokenTypeHint TokenTypeHint) error {
+	return a.RevokeTokenContext(context.Background(), token, tokenTypeHint)
+}
+
+// RevokeTokenContext is like RevokeToken but binds the request to ctx.
+func (a *appleAuth) RevokeTokenContext(ctx context.Context, token string, tokenTypeHint TokenTypeHint) error {
+	clientSecret, err := a.clientSecret()
+	if err != nil {
+		return err
+	}
+	return a.revokeToken(ctx, clientSecret, token, tokenTypeHint)
+}
+
+// RevokeTokens revokes every token with a single client secret and returns
+// the joined errors of the revocations that failed.
+func (a *appleAuth) RevokeTokens(tokens []string, tokenTypeHint TokenTypeHint) error {
+	return a.RevokeTokensContext(context.Background(), tokens, tokenTypeHint)
+}
+
+// RevokeTokensContext is like RevokeTokens but stops once ctx is done.
+func (a *appleAuth) RevokeTokensContext(ctx context.Context, tokens []string, tokenTypeHint TokenTypeHint) error {
+	clientSecret, err := a.clientSecret()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i, token := range tokens {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if err := a.revokeToken(ctx, clientSecret, token, tokenTypeHint); err != nil {
+			errs = append(errs, fmt.Errorf("revoke token %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a *appleAuth) revokeToken(ctx context.Context, clientSecret, token string, tokenTypeHint TokenTypeHint) error {
+	formQuery := make(url.Values)
+	formQuery.Add("client_id", a.AppID)
+	formQuery.Add("client_secret", clientSecret)
+	formQuery.Add("token", token)
+	if tokenTypeHint != "" {
+		formQuery.Add("token_type_hint", string(tokenTypeHint))
+	}
+
+	res, err := a.postForm(ctx, revokeEndpoint, formQuery)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		return decodeErrorResponse(res)
+	}
+	return nil
+}
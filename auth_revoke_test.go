@@ -0,0 +1,113 @@
+package apple
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRevokeToken(t *testing.T) {
+	token := "refresh-token"
+	mockedHTTPClient := new(MockedHTTPClient)
+
+	auth := appleAuth{
+		AppID:      "appID",
+		TeamID:     "teamID",
+		KeyID:      "keyID",
+		KeyContent: []byte{},
+		httpClient: mockedHTTPClient,
+	}
+	reqForm := make(url.Values)
+	reqForm.Add("client_id", auth.AppID)
+	reqForm.Add("client_secret", mockClientSecret)
+	reqForm.Add("token", token)
+	reqForm.Add("token_type_hint", "refresh_token")
+	mockedHTTPClient.On("Do", formRequest(revokeEndpoint, reqForm)).Return(
+		&http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewReader(nil)),
+		},
+		nil,
+	)
+
+	err := auth.revokeToken(context.Background(), mockClientSecret, token, TokenTypeHintRefreshToken)
+	assert.NoError(t, err)
+	mockedHTTPClient.AssertExpectations(t)
+}
+
+func TestRevokeTokenError(t *testing.T) {
+	mockedHTTPClient := new(MockedHTTPClient)
+
+	auth := appleAuth{
+		AppID:      "appID",
+		httpClient: mockedHTTPClient,
+	}
+	mockedHTTPClient.On("Do", mock.Anything).Return(
+		&http.Response{
+			StatusCode: 400,
+			Body:       io.NopCloser(bytes.NewReader([]byte(`{"error":"invalid_client"}`))),
+		},
+		nil,
+	)
+
+	err := auth.revokeToken(context.Background(), mockClientSecret, "token", TokenTypeHintAccessToken)
+	assert.ErrorIs(t, err, ErrorResponseInvalidClient)
+}
+
+func TestRevokeTokens(t *testing.T) {
+	mockedHTTPClient := new(MockedHTTPClient)
+
+	auth := appleAuth{
+		AppID:      "appID",
+		TeamID:     "teamID",
+		KeyID:      "keyID",
+		KeyContent: []byte(testECPrivateKey),
+		httpClient: mockedHTTPClient,
+	}
+	mockedHTTPClient.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+		return requestForm(req).Get("token") == "bad"
+	})).Return(
+		&http.Response{
+			StatusCode: 400,
+			Body:       io.NopCloser(bytes.NewReader([]byte(`{"error":"invalid_request"}`))),
+		},
+		nil,
+	)
+	mockedHTTPClient.On("Do", mock.Anything).Return(
+		&http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewReader(nil)),
+		},
+		nil,
+	)
+
+	err := auth.RevokeTokens([]string{"good1", "bad", "good2"}, TokenTypeHintRefreshToken)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, ErrorResponseInvalidRequest))
+	mockedHTTPClient.AssertNumberOfCalls(t, "Do", 3)
+}
+
+func TestRevokeTokensContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	mockedHTTPClient := new(MockedHTTPClient)
+	auth := appleAuth{
+		AppID:      "appID",
+		TeamID:     "teamID",
+		KeyID:      "keyID",
+		KeyContent: []byte(testECPrivateKey),
+		httpClient: mockedHTTPClient,
+	}
+
+	err := auth.RevokeTokensContext(ctx, []string{"a", "b"}, TokenTypeHintRefreshToken)
+	assert.True(t, errors.Is(err, context.Canceled))
+	mockedHTTPClient.AssertNotCalled(t, "Do", mock.Anything)
+}
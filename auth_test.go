@@ -2,13 +2,19 @@ package apple
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
 	"net/url"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -18,9 +24,9 @@ type MockedHTTPClient struct {
 	mock.Mock
 }
 
-// Mocked function PostForm that does not call any server, just return the expected response.
-func (m *MockedHTTPClient) PostForm(url string, data url.Values) (resp *http.Response, err error) {
-	args := m.Called(url, data)
+// Mocked function Do that does not call any server, just return the expected response.
+func (m *MockedHTTPClient) Do(req *http.Request) (resp *http.Response, err error) {
+	args := m.Called(req)
 
 	resArg := args.Get(0)
 	resp, ok := resArg.(*http.Response)
@@ -32,6 +38,33 @@ func (m *MockedHTTPClient) PostForm(url string, data url.Values) (resp *http.Res
 	return resp, err
 }
 
+// formRequest matches a POST request to endpoint carrying exactly form.
+func formRequest(endpoint string, form url.Values) interface{} {
+	return mock.MatchedBy(func(req *http.Request) bool {
+		return req.Method == "POST" && req.URL.String() == endpoint && reflect.DeepEqual(requestForm(req), form)
+	})
+}
+
+// requestForm decodes the form body of req without consuming it.
+func requestForm(req *http.Request) url.Values {
+	if req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil
+	}
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil
+	}
+	form, err := url.ParseQuery(string(raw))
+	if err != nil {
+		return nil
+	}
+	return form
+}
+
 const mockClientSecret = "client-secret"
 
 func TestValidateRequest(t *testing.T) {
@@ -40,7 +73,7 @@ func TestValidateRequest(t *testing.T) {
 	tokenResponse := TokenResponse{}
 	tokenResponseBody, _ := json.Marshal(tokenResponse)
 	mockedHTTPClient := new(MockedHTTPClient)
-	mockedHTTPClient.On("PostForm", validationEndpoint, form).Return(
+	mockedHTTPClient.On("Do", formRequest(validationEndpoint, form)).Return(
 		&http.Response{
 			StatusCode: 200,
 			Body:       io.NopCloser(bytes.NewReader(tokenResponseBody)),
@@ -55,7 +88,7 @@ func TestValidateRequest(t *testing.T) {
 		KeyContent: []byte{},
 		httpClient: mockedHTTPClient,
 	}
-	res, err := auth.validateRequest(form)
+	res, err := auth.validateRequest(context.Background(), form)
 	assert.Equal(t, nil, err)
 	assert.NotEqual(t, nil, res)
 }
@@ -79,7 +112,7 @@ func TestValidateCode(t *testing.T) {
 	reqForm.Add("client_secret", mockClientSecret)
 	reqForm.Add("code", code)
 	reqForm.Add("grant_type", "authorization_code")
-	mockedHTTPClient.On("PostForm", validationEndpoint, reqForm).Return(
+	mockedHTTPClient.On("Do", formRequest(validationEndpoint, reqForm)).Return(
 		&http.Response{
 			StatusCode: 200,
 			Body:       io.NopCloser(bytes.NewReader(tokenResponseBody)),
@@ -87,7 +120,7 @@ func TestValidateCode(t *testing.T) {
 		nil,
 	)
 
-	res, err := auth.validateCode(mockClientSecret, code)
+	res, err := auth.validateCode(context.Background(), mockClientSecret, code)
 	assert.Equal(t, nil, err)
 	assert.NotEqual(t, nil, res)
 }
@@ -113,7 +146,7 @@ func TestValidateCodeWithRedirectURI(t *testing.T) {
 	reqForm.Add("code", code)
 	reqForm.Add("grant_type", "authorization_code")
 	reqForm.Add("redirect_uri", redirectURI)
-	mockedHTTPClient.On("PostForm", validationEndpoint, reqForm).Return(
+	mockedHTTPClient.On("Do", formRequest(validationEndpoint, reqForm)).Return(
 		&http.Response{
 			StatusCode: 200,
 			Body:       io.NopCloser(bytes.NewReader(tokenResponseBody)),
@@ -121,7 +154,7 @@ func TestValidateCodeWithRedirectURI(t *testing.T) {
 		nil,
 	)
 
-	res, err := auth.validateCodeWithRedirectURI(mockClientSecret, code, redirectURI)
+	res, err := auth.validateCodeWithRedirectURI(context.Background(), mockClientSecret, code, redirectURI)
 	assert.Equal(t, nil, err)
 	assert.NotEqual(t, nil, res)
 }
@@ -145,7 +178,7 @@ func TestValidateRefreshToken(t *testing.T) {
 	reqForm.Add("client_secret", mockClientSecret)
 	reqForm.Add("refresh_token", refreshToken)
 	reqForm.Add("grant_type", "refresh_token")
-	mockedHTTPClient.On("PostForm", validationEndpoint, reqForm).Return(
+	mockedHTTPClient.On("Do", formRequest(validationEndpoint, reqForm)).Return(
 		&http.Response{
 			StatusCode: 200,
 			Body:       io.NopCloser(bytes.NewReader(tokenResponseBody)),
@@ -153,7 +186,191 @@ func TestValidateRefreshToken(t *testing.T) {
 		nil,
 	)
 
-	res, err := auth.validateRefreshToken(mockClientSecret, refreshToken)
+	res, err := auth.validateRefreshToken(context.Background(), mockClientSecret, refreshToken)
 	assert.Equal(t, nil, err)
 	assert.NotEqual(t, nil, res)
 }
+
+func TestValidateRequestContext(t *testing.T) {
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request-scoped")
+
+	tokenResponseBody, _ := json.Marshal(TokenResponse{})
+	mockedHTTPClient := new(MockedHTTPClient)
+	mockedHTTPClient.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+		return req.Context().Value(ctxKey{}) == "request-scoped" &&
+			req.Header.Get("Content-Type") == "application/x-www-form-urlencoded"
+	})).Return(
+		&http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewReader(tokenResponseBody)),
+		},
+		nil,
+	)
+
+	auth := appleAuth{AppID: "appID", httpClient: mockedHTTPClient}
+	_, err := auth.validateRefreshToken(ctx, mockClientSecret, "refresh-token")
+	assert.NoError(t, err)
+	mockedHTTPClient.AssertExpectations(t)
+}
+
+func TestValidateCodeContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	auth := appleAuth{AppID: "appID", httpClient: &http.Client{}}
+	_, err := auth.validateCode(ctx, mockClientSecret, "code")
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func newTestAppleAuth(client httpClient) *appleAuth {
+	return &appleAuth{
+		AppID:      "com.example.app",
+		TeamID:     "TEAM123456",
+		KeyID:      "KEYID12345",
+		KeyContent: []byte(testECPrivateKey),
+		httpClient: client,
+	}
+}
+
+func TestClientSecret(t *testing.T) {
+	auth := newTestAppleAuth(nil)
+
+	secret, err := auth.ClientSecret()
+	assert.NoError(t, err)
+
+	token, _, err := new(jwt.Parser).ParseUnverified(secret, &jwt.StandardClaims{})
+	assert.NoError(t, err)
+	claims := token.Claims.(*jwt.StandardClaims)
+	assert.Equal(t, "TEAM123456", claims.Issuer)
+	assert.Equal(t, "com.example.app", claims.Subject)
+	assert.Equal(t, appleAudience, claims.Audience)
+	assert.Equal(t, "KEYID12345", token.Header["kid"])
+	assert.Equal(t, int64(maxClientSecretLifetime/time.Second), claims.ExpiresAt-claims.IssuedAt)
+}
+
+func TestClientSecretCached(t *testing.T) {
+	auth := newTestAppleAuth(nil)
+
+	first, err := auth.ClientSecret()
+	assert.NoError(t, err)
+	second, err := auth.ClientSecret()
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+}
+
+func TestClientSecretRotatesBeforeExpiry(t *testing.T) {
+	auth := newTestAppleAuth(nil)
+	auth.ClientSecretLifetime = time.Hour
+
+	first, err := auth.ClientSecret()
+	assert.NoError(t, err)
+
+	// Within the last tenth of the lifetime a new secret is signed.
+	auth.secretExpiresAt = time.Now().Add(5 * time.Minute)
+	second, err := auth.ClientSecret()
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+	assert.True(t, auth.secretExpiresAt.After(time.Now().Add(55*time.Minute)))
+}
+
+func TestClientSecretInvalidKey(t *testing.T) {
+	auth := newTestAppleAuth(nil)
+	auth.KeyContent = []byte("not-a-key")
+
+	_, err := auth.ClientSecret()
+	assert.Error(t, err)
+}
+
+func TestClientSecretConcurrent(t *testing.T) {
+	auth := newTestAppleAuth(nil)
+
+	var wg sync.WaitGroup
+	secrets := make([]string, 16)
+	for i := range secrets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			secrets[i], _ = auth.ClientSecret()
+		}(i)
+	}
+	wg.Wait()
+
+	for _, s := range secrets {
+		assert.Equal(t, secrets[0], s)
+	}
+}
+
+func TestValidateRequestErrorResponse(t *testing.T) {
+	mockedHTTPClient := new(MockedHTTPClient)
+	mockedHTTPClient.On("Do", mock.Anything).Return(
+		&http.Response{
+			StatusCode: 400,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(`{"error":"invalid_grant","error_description":"The code has expired or has been revoked."}`)),
+		},
+		nil,
+	)
+
+	auth := appleAuth{AppID: "appID", httpClient: mockedHTTPClient}
+	_, err := auth.validateCode(context.Background(), mockClientSecret, "code")
+
+	assert.ErrorIs(t, err, ErrorResponseInvalidGrant)
+	assert.NotErrorIs(t, err, ErrorResponseInvalidClient)
+
+	var respErr ErrorResponse
+	assert.ErrorAs(t, err, &respErr)
+	assert.Equal(t, ErrorResponseTypeInvalidGrant, respErr.Type)
+
+	var apiErr *AuthAPIError
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, 400, apiErr.HTTPStatus)
+		assert.Equal(t, "The code has expired or has been revoked.", apiErr.Description)
+		assert.False(t, apiErr.Retryable())
+	}
+	assert.Equal(t, "auth api: 400: invalid_grant: The code has expired or has been revoked.", err.Error())
+}
+
+func TestValidateRequestNonJSONError(t *testing.T) {
+	html := "<html>" + strings.Repeat("x", 2*maxErrorBodyLength) + "</html>"
+	mockedHTTPClient := new(MockedHTTPClient)
+	mockedHTTPClient.On("Do", mock.Anything).Return(
+		&http.Response{
+			StatusCode: 503,
+			Header:     http.Header{"Retry-After": []string{"120"}},
+			Body:       io.NopCloser(strings.NewReader(html)),
+		},
+		nil,
+	)
+
+	auth := appleAuth{AppID: "appID", httpClient: mockedHTTPClient}
+	_, err := auth.validateRefreshToken(context.Background(), mockClientSecret, "refresh-token")
+
+	var apiErr *AuthAPIError
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, 503, apiErr.HTTPStatus)
+		assert.Equal(t, 120, apiErr.RetryAfter)
+		assert.Empty(t, apiErr.Type)
+		assert.Len(t, apiErr.Body, maxErrorBodyLength)
+		assert.True(t, apiErr.Retryable())
+	}
+	assert.True(t, IsRetryable(err))
+	assert.False(t, IsRetryable(errors.New("other")))
+}
+
+func TestValidateRequestEmptyErrorBody(t *testing.T) {
+	mockedHTTPClient := new(MockedHTTPClient)
+	mockedHTTPClient.On("Do", mock.Anything).Return(
+		&http.Response{
+			StatusCode: 429,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("")),
+		},
+		nil,
+	)
+
+	auth := appleAuth{AppID: "appID", httpClient: mockedHTTPClient}
+	_, err := auth.validateCode(context.Background(), mockClientSecret, "code")
+	assert.True(t, IsRetryable(err))
+	assert.Equal(t, "auth api: 429", err.Error())
+}
@@ -0,0 +1,135 @@
+package apple
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultTokenExpiryDelta is how long before expires_in a cached access
+// token is replaced.
+const defaultTokenExpiryDelta = time.Minute
+
+// ClientCredentialsToken requests an app-level access token for scopes with
+// the client credentials grant, e.g. for the user.migration scope.
+func (a *appleAuth) ClientCredentialsToken(scopes ...string) (*TokenResponse, error) {
+	return a.ClientCredentialsTokenContext(context.Background(), scopes...)
+}
+
+// ClientCredentialsTokenContext is like ClientCredentialsToken but binds the
+// request to ctx.
+func (a *appleAuth) ClientCredentialsTokenContext(ctx context.Context, scopes ...string) (*TokenResponse, error) {
+	clientSecret, err := a.clientSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	formQuery := make(url.Values)
+	formQuery.Add("client_id", a.AppID)
+	formQuery.Add("client_secret", clientSecret)
+	formQuery.Add("grant_type", "client_credentials")
+	if len(scopes) > 0 {
+		formQuery.Add("scope", strings.Join(scopes, " "))
+	}
+	return a.validateRequest(ctx, formQuery)
+}
+
+// TokenSource hands out client credentials access tokens, requesting a new
+// one only shortly before the cached token expires. Concurrent callers
+// share a single request. A TokenSource is safe for concurrent use.
+type TokenSource struct {
+	// ExpiryDelta is how long before its expiry a token is replaced.
+	// Defaults to one minute, and at most half the token lifetime is used.
+	ExpiryDelta time.Duration
+
+	auth   AppleAuth
+	scopes []string
+	now    func() time.Time
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// NewTokenSource creates a TokenSource requesting tokens for scopes from
+// auth.
+func NewTokenSource(auth AppleAuth, scopes ...string) *TokenSource {
+	return &TokenSource{
+		ExpiryDelta: defaultTokenExpiryDelta,
+		auth:        auth,
+		scopes:      append([]string(nil), scopes...),
+		now:         time.Now,
+	}
+}
+
+// Token returns a valid access token, requesting a new one if needed.
+func (s *TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.token != "" && now.Before(s.expiresAt) {
+		return s.token, nil
+	}
+
+	res, err := s.auth.ClientCredentialsTokenContext(ctx, s.scopes...)
+	if err != nil {
+		return "", err
+	}
+	if res.AccessToken == "" {
+		return "", errors.New("empty access token")
+	}
+
+	lifetime := time.Duration(res.ExpiresIn) * time.Second
+	delta := s.ExpiryDelta
+	if delta <= 0 || delta > lifetime/2 {
+		delta = lifetime / 2
+	}
+
+	s.token = res.AccessToken
+	s.expiresAt = now.Add(lifetime - delta)
+	return s.token, nil
+}
+
+// Invalidate drops the cached token, e.g. after it was rejected, so the
+// next call to Token requests a new one.
+func (s *TokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = ""
+	s.expiresAt = time.Time{}
+}
+
+// Transport is an http.RoundTripper that authenticates each request with a
+// bearer token from Source.
+type Transport struct {
+	// Source provides the tokens. Required.
+	Source *TokenSource
+	// Base sends the requests. Defaults to http.DefaultTransport.
+	Base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper. The request is cloned before the
+// Authorization header is set.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.Source.Token(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,122 @@
+package apple
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newClientCredentialsServer answers client credentials grants with
+// numbered tokens and counts them.
+func newClientCredentialsServer(t *testing.T, expiresIn int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var issued atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.PostForm.Get("grant_type") != "client_credentials" || r.PostForm.Get("scope") != "user.migration" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_request"}`))
+			return
+		}
+		n := issued.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		_, _ = fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":%d}`, n, expiresIn)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &issued
+}
+
+func TestClientCredentialsToken(t *testing.T) {
+	srv, _ := newClientCredentialsServer(t, 3600)
+	auth, err := NewB64("com.example.app", "TEAM123456", "KEYID12345", testKeyB64(), WithBaseURL(srv.URL))
+	assert.NoError(t, err)
+
+	token, err := auth.ClientCredentialsToken(userMigrationScope)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", token.AccessToken)
+	assert.Equal(t, 3600, token.ExpiresIn)
+
+	_, err = auth.ClientCredentialsToken("unknown")
+	assert.ErrorIs(t, err, ErrorResponseInvalidRequest)
+}
+
+func TestTokenSourceCaches(t *testing.T) {
+	srv, issued := newClientCredentialsServer(t, 3600)
+	auth, err := NewB64("com.example.app", "TEAM123456", "KEYID12345", testKeyB64(), WithBaseURL(srv.URL))
+	assert.NoError(t, err)
+
+	now := time.Now()
+	source := NewTokenSource(auth, userMigrationScope)
+	source.now = func() time.Time { return now }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := source.Token(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, "token-1", token)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), issued.Load())
+
+	// Within the last minute before expiry a new token is requested.
+	now = now.Add(59*time.Minute + time.Second)
+	token, err := source.Token(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+
+	source.Invalidate()
+	token, err = source.Token(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-3", token)
+}
+
+func TestTokenSourceShortLifetime(t *testing.T) {
+	srv, issued := newClientCredentialsServer(t, 60)
+	auth, err := NewB64("com.example.app", "TEAM123456", "KEYID12345", testKeyB64(), WithBaseURL(srv.URL))
+	assert.NoError(t, err)
+
+	source := NewTokenSource(auth, userMigrationScope)
+	_, err = source.Token(context.Background())
+	assert.NoError(t, err)
+	_, err = source.Token(context.Background())
+	assert.NoError(t, err)
+	// Half of the lifetime is used instead of the full delta.
+	assert.Equal(t, int32(1), issued.Load())
+}
+
+func TestTransport(t *testing.T) {
+	tokenSrv, _ := newClientCredentialsServer(t, 3600)
+	auth, err := NewB64("com.example.app", "TEAM123456", "KEYID12345", testKeyB64(), WithBaseURL(tokenSrv.URL))
+	assert.NoError(t, err)
+
+	var authorization string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer api.Close()
+
+	client := &http.Client{Transport: &Transport{Source: NewTokenSource(auth, userMigrationScope)}}
+	req, _ := http.NewRequest("GET", api.URL, nil)
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, "Bearer token-1", authorization)
+	// The caller's request is left untouched.
+	assert.Empty(t, req.Header.Get("Authorization"))
+
+	failing := &http.Client{Transport: &Transport{Source: NewTokenSource(auth, "unknown")}}
+	_, err = failing.Get(api.URL)
+	assert.ErrorIs(t, err, ErrorResponseInvalidRequest)
+}
@@ -0,0 +1,214 @@
+package apple
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// maxCallbackBodySize limits the size of the form posted by Apple.
+	maxCallbackBodySize = 64 << 10
+
+	appleErrorUserCancelled = "user_cancelled_authorize"
+)
+
+// CallbackResult is the outcome of a successful authorization callback.
+type CallbackResult struct {
+	// State is the verified state returned by Apple.
+	State string
+	// Token is the response of the authorization code exchange.
+	Token *TokenResponse
+	// User holds the claims of the verified ID token.
+	User *AppleUser
+	// RawUser is the JSON user object Apple posts on the first
+	// authorization only. It is empty on subsequent sign-ins.
+	RawUser string
+	// Profile is RawUser parsed and merged into User. It is nil on
+	// subsequent sign-ins.
+	Profile *AppleUserProfile
+	// EmailMismatch reports that the email in Profile differs from the email
+	// claim of the ID token.
+	EmailMismatch bool
+}
+
+// CallbackHandler is an http.Handler receiving the form_post callback of
+// Sign in with Apple. It verifies the state, exchanges the authorization
+// code, verifies the returned ID token and passes the result to OnSuccess.
+type CallbackHandler struct {
+	// Auth exchanges the authorization code. Required.
+	Auth AppleAuth
+	// Keys verifies the ID token signature. Required.
+	Keys *KeySet
+	// States checks the state parameter. Required. If it implements
+	// StateClearer, the state is cleared on every callback response.
+	States StateStore
+	// Options are applied to the ID token. The nonce bound to the state, if
+	// any, overrides Options.Nonce.
+	Options IDTokenOptions
+	// RedirectURI is sent with the code exchange. It must match the one used
+	// in the authorization request for the web flow.
+	RedirectURI string
+	// ErrorRedirectURL, when set, makes the default error handling redirect
+	// there with an error query parameter instead of replying with an error
+	// status. It is how a cancelled sign-in is sent back to the login page.
+	ErrorRedirectURL string
+
+	// OnSuccess is called with the verified result and writes the response,
+	// typically a session cookie and a redirect. A returned error is passed
+	// to OnError. Required; without it every callback fails before the
+	// code is exchanged.
+	OnSuccess func(w http.ResponseWriter, r *http.Request, result *CallbackResult) error
+	// OnError handles any failure. Without it the handler redirects to
+	// ErrorRedirectURL if set, and otherwise replies with 400 for rejected
+	// callbacks and 500 for anything else.
+	OnError func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// ServeHTTP implements http.Handler.
+func (h *CallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.OnSuccess == nil {
+		h.handleError(w, r, errors.New("callback handler has no OnSuccess"))
+		return
+	}
+	// The state is spent by this callback, whether it succeeds or not.
+	if c, ok := h.States.(StateClearer); ok {
+		c.Clear(w)
+	}
+
+	result, err := h.handle(r)
+	if err == nil {
+		err = h.OnSuccess(w, r, result)
+	}
+	if err != nil {
+		h.handleError(w, r, err)
+	}
+}
+
+func (h *CallbackHandler) handle(r *http.Request) (*CallbackResult, error) {
+	if r.Method != http.MethodPost {
+		return nil, &CallbackError{Code: CallbackErrorInvalidRequest, Reason: "method not allowed"}
+	}
+
+	r.Body = http.MaxBytesReader(nil, r.Body, maxCallbackBodySize)
+	if err := r.ParseForm(); err != nil {
+		return nil, &CallbackError{Code: CallbackErrorInvalidRequest, Reason: err.Error()}
+	}
+
+	if appleErr := r.PostForm.Get("error"); appleErr != "" {
+		if appleErr == appleErrorUserCancelled {
+			return nil, &CallbackError{Code: CallbackErrorUserCancelled, Reason: appleErr}
+		}
+		return nil, &CallbackError{Code: CallbackErrorAppleError, Reason: appleErr}
+	}
+
+	state := r.PostForm.Get("state")
+	if state == "" {
+		return nil, &CallbackError{Code: CallbackErrorInvalidState, Reason: "missing state"}
+	}
+	nonce, err := h.States.Consume(r, state)
+	if err != nil {
+		return nil, err
+	}
+
+	code := r.PostForm.Get("code")
+	if code == "" {
+		return nil, &CallbackError{Code: CallbackErrorInvalidRequest, Reason: "missing code"}
+	}
+
+	// Reject a malformed user field before the single-use code is spent.
+	rawUser := r.PostForm.Get("user")
+	profile, err := ParseUserProfile(rawUser)
+	if err != nil {
+		return nil, &CallbackError{Code: CallbackErrorInvalidRequest, Reason: "invalid user: " + err.Error()}
+	}
+
+	var token *TokenResponse
+	if h.RedirectURI != "" {
+		token, err = h.Auth.ValidateCodeWithRedirectURIContext(r.Context(), code, h.RedirectURI)
+	} else {
+		token, err = h.Auth.ValidateCodeContext(r.Context(), code)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	opts := h.Options
+	if nonce != "" {
+		opts.Nonce = nonce
+	}
+	user, err := VerifyIDTokenWithOptionsContext(r.Context(), h.Keys, token.IDToken, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Bind the ID token to the code and access token it was returned with.
+	if user.CodeHash != "" {
+		if err := user.VerifyCodeHash(code); err != nil {
+			return nil, err
+		}
+	}
+	if user.AccessTokenHash != "" {
+		if err := user.VerifyAccessTokenHash(token.AccessToken); err != nil {
+			return nil, err
+		}
+	}
+
+	return &CallbackResult{
+		State:         state,
+		Token:         token,
+		User:          user,
+		RawUser:       rawUser,
+		Profile:       profile,
+		EmailMismatch: user.MergeProfile(profile),
+	}, nil
+}
+
+// handleError passes err to OnError or applies the default handling.
+func (h *CallbackHandler) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if h.OnError != nil {
+		h.OnError(w, r, err)
+		return
+	}
+
+	if h.ErrorRedirectURL != "" {
+		u, parseErr := url.Parse(h.ErrorRedirectURL)
+		if parseErr == nil {
+			q := u.Query()
+			q.Set("error", callbackErrorParam(err))
+			u.RawQuery = q.Encode()
+			http.Redirect(w, r, u.String(), http.StatusSeeOther)
+			return
+		}
+	}
+
+	status := http.StatusInternalServerError
+	var cbErr *CallbackError
+	var idErr *IDTokenError
+	var respErr ErrorResponse
+	if errors.As(err, &cbErr) || errors.As(err, &idErr) || errors.As(err, &respErr) {
+		status = http.StatusBadRequest
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// callbackErrorParam returns the value of the error query parameter used
+// when redirecting to ErrorRedirectURL.
+func callbackErrorParam(err error) string {
+	var cbErr *CallbackError
+	if errors.As(err, &cbErr) {
+		if cbErr.Code == CallbackErrorUserCancelled || cbErr.Code == CallbackErrorAppleError {
+			return cbErr.Reason
+		}
+		return strings.ToLower(string(cbErr.Code))
+	}
+	var idErr *IDTokenError
+	if errors.As(err, &idErr) {
+		return "invalid_token"
+	}
+	var respErr ErrorResponse
+	if errors.As(err, &respErr) {
+		return string(respErr.Type)
+	}
+	return "server_error"
+}
@@ -0,0 +1,273 @@
+package apple
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	gojwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// newTestCallbackHandler returns a handler whose code exchange responds with
+// an ID token built from claims.
+func newTestCallbackHandler(t *testing.T, claims gojwt.MapClaims) (*CallbackHandler, *MemoryStateStore) {
+	t.Helper()
+
+	srv := newTestJWKSServer(t, "kid1")
+	tokenResponseBody, _ := json.Marshal(TokenResponse{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		IDToken:      srv.sign(t, "kid1", claims),
+	})
+
+	mockedHTTPClient := new(MockedHTTPClient)
+	mockedHTTPClient.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+		form := requestForm(req)
+		return form.Get("code") == "auth-code" && form.Get("redirect_uri") == "https://example.com/callback"
+	})).Return(
+		&http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewReader(tokenResponseBody)),
+		},
+		nil,
+	)
+	mockedHTTPClient.On("Do", mock.Anything).Return(
+		&http.Response{
+			StatusCode: 400,
+			Body:       io.NopCloser(bytes.NewReader([]byte(`{"error":"invalid_grant"}`))),
+		},
+		nil,
+	)
+
+	states := NewMemoryStateStore(time.Minute)
+	return &CallbackHandler{
+		Auth:        newTestAppleAuth(mockedHTTPClient),
+		Keys:        NewKeySet(srv.server.URL),
+		States:      states,
+		Options:     IDTokenOptions{Audiences: []string{"com.example.app"}},
+		RedirectURI: "https://example.com/callback",
+		OnSuccess: func(w http.ResponseWriter, r *http.Request, res *CallbackResult) error {
+			return nil
+		},
+	}, states
+}
+
+func postCallback(h http.Handler, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/callback", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCallbackHandler(t *testing.T) {
+	h, states := newTestCallbackHandler(t, testIDTokenClaims(time.Now()))
+	states.Save("state-1", "raw-nonce")
+
+	var result *CallbackResult
+	h.OnSuccess = func(w http.ResponseWriter, r *http.Request, res *CallbackResult) error {
+		result = res
+		http.Redirect(w, r, "/home", http.StatusSeeOther)
+		return nil
+	}
+
+	rec := postCallback(h, url.Values{
+		"code":  {"auth-code"},
+		"state": {"state-1"},
+		"user":  {`{"name":{"firstName":"Jane","lastName":"Doe"},"email":"jane@example.com"}`},
+	})
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+	if assert.NotNil(t, result) {
+		assert.Equal(t, "state-1", result.State)
+		assert.Equal(t, "001234.abcd", result.User.Subject)
+		assert.Equal(t, "refresh-token", result.Token.RefreshToken)
+		assert.Contains(t, result.RawUser, "Jane")
+		if assert.NotNil(t, result.Profile) {
+			assert.Equal(t, "Jane", result.Profile.FirstName)
+			assert.Equal(t, "Doe", result.Profile.LastName)
+		}
+		assert.Equal(t, result.Profile, result.User.Profile)
+		// The token has no email claim; the unsigned profile email is not
+		// promoted to the verified one.
+		assert.Empty(t, result.User.Email)
+		assert.Equal(t, "jane@example.com", result.Profile.Email)
+		assert.False(t, result.EmailMismatch)
+	}
+
+	// The state cannot be replayed.
+	rec = postCallback(h, url.Values{"code": {"auth-code"}, "state": {"state-1"}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestCallbackHandlerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		form url.Values
+		code string
+	}{
+		{"user cancelled", url.Values{"error": {"user_cancelled_authorize"}, "state": {"state-1"}}, "user_cancelled_authorize"},
+		{"missing state", url.Values{"code": {"auth-code"}}, "invalid_state"},
+		{"unknown state", url.Values{"code": {"auth-code"}, "state": {"other"}}, "invalid_state"},
+		{"missing code", url.Values{"state": {"state-1"}}, "invalid_request"},
+		{"malformed user", url.Values{"code": {"auth-code"}, "state": {"state-1"}, "user": {"{"}}, "invalid_request"},
+		{"invalid code", url.Values{"code": {"bad-code"}, "state": {"state-1"}}, "invalid_grant"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, states := newTestCallbackHandler(t, testIDTokenClaims(time.Now()))
+			states.Save("state-1", "")
+			h.ErrorRedirectURL = "https://example.com/login"
+			h.OnSuccess = func(w http.ResponseWriter, r *http.Request, res *CallbackResult) error {
+				t.Fatal("OnSuccess must not be called")
+				return nil
+			}
+
+			rec := postCallback(h, tt.form)
+			assert.Equal(t, http.StatusSeeOther, rec.Code)
+			assert.Equal(t, "https://example.com/login?error="+tt.code, rec.Header().Get("Location"))
+		})
+	}
+}
+
+func TestCallbackHandlerNonceMismatch(t *testing.T) {
+	h, states := newTestCallbackHandler(t, testIDTokenClaims(time.Now()))
+	states.Save("state-1", "other-nonce")
+
+	var gotErr error
+	h.OnError = func(w http.ResponseWriter, r *http.Request, err error) {
+		gotErr = err
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	rec := postCallback(h, url.Values{"code": {"auth-code"}, "state": {"state-1"}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assertIDTokenError(t, gotErr, IDTokenErrorNonceMismatch)
+}
+
+func TestCallbackHandlerOnSuccessError(t *testing.T) {
+	h, states := newTestCallbackHandler(t, testIDTokenClaims(time.Now()))
+	states.Save("state-1", "")
+	h.OnSuccess = func(w http.ResponseWriter, r *http.Request, res *CallbackResult) error {
+		return errors.New("database unavailable")
+	}
+
+	rec := postCallback(h, url.Values{"code": {"auth-code"}, "state": {"state-1"}})
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestCallbackHandlerWithoutOnSuccess(t *testing.T) {
+	h, states := newTestCallbackHandler(t, testIDTokenClaims(time.Now()))
+	states.Save("state-1", "")
+	h.OnSuccess = nil
+
+	rec := postCallback(h, url.Values{"code": {"auth-code"}, "state": {"state-1"}})
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	// The code was not spent and the state is still valid.
+	h.Auth.(*appleAuth).httpClient.(*MockedHTTPClient).AssertNotCalled(t, "Do", mock.Anything)
+	_, err := states.Consume(nil, "state-1")
+	assert.NoError(t, err)
+}
+
+func TestCallbackHandlerMalformedUserKeepsCode(t *testing.T) {
+	h, states := newTestCallbackHandler(t, testIDTokenClaims(time.Now()))
+	states.Save("state-1", "")
+
+	rec := postCallback(h, url.Values{"code": {"auth-code"}, "state": {"state-1"}, "user": {"{"}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	h.Auth.(*appleAuth).httpClient.(*MockedHTTPClient).AssertNotCalled(t, "Do", mock.Anything)
+}
+
+func TestCallbackHandlerMethodNotAllowed(t *testing.T) {
+	h, _ := newTestCallbackHandler(t, testIDTokenClaims(time.Now()))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/callback?code=auth-code", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestCallbackHandlerAccessTokenHashMismatch(t *testing.T) {
+	claims := testIDTokenClaims(time.Now())
+	claims["at_hash"] = "77QmUPtjPfzWtF2AnpK9RQ"
+	h, states := newTestCallbackHandler(t, claims)
+	states.Save("state-1", "")
+
+	var gotErr error
+	h.OnError = func(w http.ResponseWriter, r *http.Request, err error) {
+		gotErr = err
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	rec := postCallback(h, url.Values{"code": {"auth-code"}, "state": {"state-1"}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assertIDTokenError(t, gotErr, IDTokenErrorATHashMismatch)
+}
+
+func TestCallbackHandlerCodeHash(t *testing.T) {
+	sum := sha256.Sum256([]byte("auth-code"))
+
+	for name, tt := range map[string]struct {
+		cHash  string
+		status int
+	}{
+		"match":    {base64.RawURLEncoding.EncodeToString(sum[:16]), http.StatusOK},
+		"mismatch": {"77QmUPtjPfzWtF2AnpK9RQ", http.StatusUnauthorized},
+	} {
+		t.Run(name, func(t *testing.T) {
+			claims := testIDTokenClaims(time.Now())
+			claims["c_hash"] = tt.cHash
+			h, states := newTestCallbackHandler(t, claims)
+			states.Save("state-1", "")
+
+			var gotErr error
+			h.OnError = func(w http.ResponseWriter, r *http.Request, err error) {
+				gotErr = err
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+
+			rec := postCallback(h, url.Values{"code": {"auth-code"}, "state": {"state-1"}})
+			assert.Equal(t, tt.status, rec.Code)
+			if tt.status != http.StatusOK {
+				assertIDTokenError(t, gotErr, IDTokenErrorCodeHashMismatch)
+			}
+		})
+	}
+}
+
+func TestCallbackHandlerClearsStateCookie(t *testing.T) {
+	for name, form := range map[string]url.Values{
+		"success":      {"code": {"auth-code"}, "state": {"state-1"}},
+		"invalid code": {"code": {"bad-code"}, "state": {"state-1"}},
+		"cancelled":    {"error": {"user_cancelled_authorize"}, "state": {"state-1"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			h, _ := newTestCallbackHandler(t, testIDTokenClaims(time.Now()))
+			states := NewCookieStateStore([]byte("0123456789abcdef0123456789abcdef"))
+			h.States = states
+
+			req := issueCookie(t, states, "state-1", "raw-nonce")
+			req.Body = io.NopCloser(strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			cookies := rec.Result().Cookies()
+			if assert.Len(t, cookies, 1) {
+				assert.Equal(t, "apple_auth_state", cookies[0].Name)
+				assert.Equal(t, -1, cookies[0].MaxAge)
+			}
+		})
+	}
+}
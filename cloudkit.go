@@ -2,8 +2,6 @@ package apple
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
@@ -54,54 +52,78 @@ type cloudKit struct {
 	Environment CKEnvironment
 	KeyContent  []byte
 	httpClient  ckHTTPClient
+	signer      Signer
+	baseURL     string
+	now         func() time.Time
 }
 
 // NewCloudKit creates a new CloudKit client using a key file path.
-func NewCloudKit(keyID, container string, environment CKEnvironment, keyPath string) (CloudKit, error) {
+func NewCloudKit(keyID, container string, environment CKEnvironment, keyPath string, opts ...Option) (CloudKit, error) {
 	keyContent, err := os.ReadFile(keyPath)
 	if err != nil {
 		return nil, err
 	}
-	return &cloudKit{
-		KeyID:       keyID,
-		Container:   container,
-		Environment: environment,
-		KeyContent:  keyContent,
-		httpClient:  &http.Client{Timeout: 10 * time.Second},
-	}, nil
+	return newCloudKit(keyID, container, environment, keyContent, nil, opts), nil
 }
 
 // NewCloudKitB64 creates a new CloudKit client using a base64-encoded key.
-func NewCloudKitB64(keyID, container string, environment CKEnvironment, b64Key string) (CloudKit, error) {
+func NewCloudKitB64(keyID, container string, environment CKEnvironment, b64Key string, opts ...Option) (CloudKit, error) {
 	keyContent, err := base64.StdEncoding.DecodeString(b64Key)
 	if err != nil {
 		return nil, err
 	}
+	return newCloudKit(keyID, container, environment, keyContent, nil, opts), nil
+}
+
+// NewCloudKitWithSigner creates a new CloudKit client that signs its
+// requests with signer, e.g. with a key held in a KMS.
+func NewCloudKitWithSigner(container string, environment CKEnvironment, signer Signer, opts ...Option) (CloudKit, error) {
+	if signer == nil {
+		return nil, errNilSigner
+	}
+	return newCloudKit(signer.KeyID(), container, environment, nil, signer, opts), nil
+}
+
+func newCloudKit(keyID, container string, environment CKEnvironment, keyContent []byte, signer Signer, opts []Option) *cloudKit {
+	o := newClientOptions(10*time.Second, opts)
 	return &cloudKit{
 		KeyID:       keyID,
 		Container:   container,
 		Environment: environment,
 		KeyContent:  keyContent,
-		httpClient:  &http.Client{Timeout: 10 * time.Second},
-	}, nil
+		httpClient:  o.client(),
+		signer:      signer,
+		baseURL:     o.baseURL,
+		now:         o.now,
+	}
 }
 
 // buildURL constructs the full URL and returns the subpath used for signing.
 func (c *cloudKit) buildURL(db CKDatabase, subpath string) (fullURL, urlSubpath string) {
 	urlSubpath = fmt.Sprintf("/database/%s/%s/%s/%s/%s",
 		cloudKitVersion, c.Container, string(c.Environment), string(db), subpath)
-	fullURL = cloudKitBaseURL + urlSubpath
+	baseURL := cloudKitBaseURL
+	if c.baseURL != "" {
+		baseURL = c.baseURL
+	}
+	fullURL = baseURL + urlSubpath
 	return fullURL, urlSubpath
 }
 
 // sign creates the CloudKit ECDSA signature for a request.
 func (c *cloudKit) sign(body []byte, subpath string) (date, signature string, err error) {
-	privateKey, err := parseECPrivateKey(c.KeyContent)
-	if err != nil {
-		return "", "", err
+	signer := c.signer
+	if signer == nil {
+		if signer, err = NewPEMSigner(c.KeyID, c.KeyContent); err != nil {
+			return "", "", err
+		}
 	}
 
-	date = time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	now := time.Now()
+	if c.now != nil {
+		now = c.now()
+	}
+	date = now.UTC().Format("2006-01-02T15:04:05Z")
 
 	bodyHash := sha256.Sum256(body)
 	bodyHashB64 := base64.StdEncoding.EncodeToString(bodyHash[:])
@@ -109,7 +131,7 @@ func (c *cloudKit) sign(body []byte, subpath string) (date, signature string, er
 	message := fmt.Sprintf("%s:%s:%s", date, bodyHashB64, subpath)
 	messageHash := sha256.Sum256([]byte(message))
 
-	sig, err := ecdsa.SignASN1(rand.Reader, privateKey, messageHash[:])
+	sig, err := signer.Sign(messageHash[:])
 	if err != nil {
 		return "", "", err
 	}
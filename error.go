@@ -1,6 +1,10 @@
 package apple
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
 
 var (
 	// ErrorResponseTypeInvalidRequest the request is malformed, typically
@@ -80,3 +84,150 @@ type ErrorResponse struct {
 func (e ErrorResponse) Error() string {
 	return fmt.Sprintf("%s: %s", e.Type, e.Message)
 }
+
+// IDTokenErrorCode represents the reason an ID token was rejected.
+type IDTokenErrorCode string
+
+const (
+	IDTokenErrorMalformed        IDTokenErrorCode = "MALFORMED"
+	IDTokenErrorUnverifiable     IDTokenErrorCode = "UNVERIFIABLE"
+	IDTokenErrorUnknownKey       IDTokenErrorCode = "UNKNOWN_KEY"
+	IDTokenErrorInvalidSignature IDTokenErrorCode = "INVALID_SIGNATURE"
+	IDTokenErrorInvalidIssuer    IDTokenErrorCode = "INVALID_ISSUER"
+	IDTokenErrorInvalidAudience  IDTokenErrorCode = "INVALID_AUDIENCE"
+	IDTokenErrorExpired          IDTokenErrorCode = "EXPIRED"
+	IDTokenErrorIssuedInFuture   IDTokenErrorCode = "ISSUED_IN_FUTURE"
+	IDTokenErrorTooOld           IDTokenErrorCode = "TOO_OLD"
+	IDTokenErrorNonceMismatch    IDTokenErrorCode = "NONCE_MISMATCH"
+	IDTokenErrorCodeHashMismatch IDTokenErrorCode = "CODE_HASH_MISMATCH"
+	IDTokenErrorATHashMismatch   IDTokenErrorCode = "AT_HASH_MISMATCH"
+)
+
+// IDTokenError represents an ID token verification failure.
+type IDTokenError struct {
+	Code   IDTokenErrorCode `json:"code,omitempty"`
+	Reason string           `json:"reason,omitempty"`
+}
+
+// Error implements the error interface.
+func (e *IDTokenError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("id token: %s: %s", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("id token: %s", e.Code)
+}
+
+// CallbackErrorCode represents the reason a Sign in with Apple callback was
+// rejected.
+type CallbackErrorCode string
+
+const (
+	CallbackErrorUserCancelled  CallbackErrorCode = "USER_CANCELLED"
+	CallbackErrorAppleError     CallbackErrorCode = "APPLE_ERROR"
+	CallbackErrorInvalidRequest CallbackErrorCode = "INVALID_REQUEST"
+	CallbackErrorInvalidState   CallbackErrorCode = "INVALID_STATE"
+)
+
+// CallbackError represents a failure while handling the authorization
+// callback.
+type CallbackError struct {
+	Code   CallbackErrorCode `json:"code,omitempty"`
+	Reason string            `json:"reason,omitempty"`
+}
+
+// Error implements the error interface.
+func (e *CallbackError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("callback: %s: %s", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("callback: %s", e.Code)
+}
+
+// AuthorizeURLErrorCode represents the reason an authorization URL config
+// was rejected.
+type AuthorizeURLErrorCode string
+
+const (
+	AuthorizeURLErrorMissingClientID     AuthorizeURLErrorCode = "MISSING_CLIENT_ID"
+	AuthorizeURLErrorInvalidRedirectURI  AuthorizeURLErrorCode = "INVALID_REDIRECT_URI"
+	AuthorizeURLErrorInvalidEndpoint     AuthorizeURLErrorCode = "INVALID_ENDPOINT"
+	AuthorizeURLErrorInvalidResponseMode AuthorizeURLErrorCode = "INVALID_RESPONSE_MODE"
+	AuthorizeURLErrorInvalidResponseType AuthorizeURLErrorCode = "INVALID_RESPONSE_TYPE"
+	AuthorizeURLErrorInvalidScope        AuthorizeURLErrorCode = "INVALID_SCOPE"
+	AuthorizeURLErrorInvalidCombination  AuthorizeURLErrorCode = "INVALID_COMBINATION"
+)
+
+// AuthorizeURLError represents an invalid authorization URL config.
+type AuthorizeURLError struct {
+	Code   AuthorizeURLErrorCode `json:"code,omitempty"`
+	Reason string                `json:"reason,omitempty"`
+}
+
+// Error implements the error interface.
+func (e *AuthorizeURLError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("authorize url: %s: %s", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("authorize url: %s", e.Code)
+}
+
+// AuthAPIError is returned when one of Apple's auth endpoints (token,
+// revoke, user migration) answers with an error. It matches the
+// ErrorResponse value of its Type with errors.Is and errors.As.
+type AuthAPIError struct {
+	// Type is the error code from the response body, empty if the body was
+	// not a JSON error, e.g. an HTML page on a 5xx.
+	Type ErrorResponseType `json:"error,omitempty"`
+	// Description is the optional error_description from the response body.
+	Description string `json:"error_description,omitempty"`
+	HTTPStatus  int    `json:"-"`
+	// RetryAfter is the Retry-After header in seconds, zero if absent.
+	RetryAfter int `json:"-"`
+	// Body is the start of the raw response body.
+	Body string `json:"-"`
+}
+
+// Error implements the error interface.
+func (e *AuthAPIError) Error() string {
+	msg := fmt.Sprintf("auth api: %d", e.HTTPStatus)
+	if e.Type != "" {
+		msg += ": " + string(e.Type)
+	}
+	if e.Description != "" {
+		msg += ": " + e.Description
+	}
+	return msg
+}
+
+// Unwrap returns the ErrorResponse value matching Type, if any.
+func (e *AuthAPIError) Unwrap() error {
+	switch e.Type {
+	case ErrorResponseTypeInvalidRequest:
+		return ErrorResponseInvalidRequest
+	case ErrorResponseTypeInvalidClient:
+		return ErrorResponseInvalidClient
+	case ErrorResponseTypeInvalidGrant:
+		return ErrorResponseInvalidGrant
+	case ErrorResponseTypeUnauthorizedClient:
+		return ErrorResponseUnauthorizedClient
+	case ErrorResponseTypeUnsupportedGrantType:
+		return ErrorResponseUnsupportedGrantType
+	case ErrorResponseTypeInvalidScope:
+		return ErrorResponseInvalidScope
+	default:
+		return nil
+	}
+}
+
+// Retryable reports whether the request may succeed when retried later,
+// i.e. Apple was rate limiting or failing rather than rejecting it.
+func (e *AuthAPIError) Retryable() bool {
+	return e.HTTPStatus == http.StatusTooManyRequests || e.HTTPStatus >= http.StatusInternalServerError
+}
+
+// IsRetryable reports whether err is an *AuthAPIError that may succeed when
+// retried later.
+func IsRetryable(err error) bool {
+	var apiErr *AuthAPIError
+	return errors.As(err, &apiErr) && apiErr.Retryable()
+}
@@ -6,6 +6,7 @@ require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/stretchr/testify v1.11.0
 	github.com/tideland/gorest v2.15.5+incompatible
+	golang.org/x/crypto v0.45.0
 )
 
 require (
@@ -0,0 +1,195 @@
+package apple
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	gojwt "github.com/dgrijalva/jwt-go"
+)
+
+// IDTokenOptions configures the claim checks performed on a verified
+// Apple ID token. Audiences is required; the other checks are optional.
+type IDTokenOptions struct {
+	// Audiences lists the accepted client IDs, i.e. Services IDs for the web
+	// flow and bundle IDs for native apps. The aud claim must match one of
+	// them. Required: without it a token Apple issued for any other app
+	// would be accepted.
+	Audiences []string
+
+	// Nonce is the raw nonce sent with the authorization request. Native
+	// apps send the SHA-256 hash of the nonce to Apple while the web flow
+	// sends it as is, so the nonce claim may hold either the raw value or
+	// its hex-encoded SHA-256 hash. An empty Nonce skips the check.
+	Nonce string
+
+	// ClockSkew is the tolerance applied to the exp and iat checks.
+	ClockSkew time.Duration
+
+	// MaxAge rejects tokens issued longer ago than MaxAge. Zero disables
+	// the check.
+	MaxAge time.Duration
+
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// VerifyIDToken verifies the RS256 signature of the JWT id token against the
+// public keys in keys and retrieves the user info from it. Unlike
+// GetUserInfoFromIDToken it rejects tokens that were not signed by Apple.
+// The issuer, expiry and audience are checked; the aud claim must match one
+// of audiences. Use VerifyIDTokenWithOptions to check the nonce as well.
+func VerifyIDToken(keys *KeySet, idToken string, audiences ...string) (*AppleUser, error) {
+	return VerifyIDTokenWithOptions(keys, idToken, IDTokenOptions{Audiences: audiences})
+}
+
+// VerifyIDTokenWithOptions verifies the signature of the JWT id token and
+// validates its claims against opts. Token failures are returned as
+// *IDTokenError; options without audiences are rejected with a plain error.
+func VerifyIDTokenWithOptions(keys *KeySet, idToken string, opts IDTokenOptions) (*AppleUser, error) {
+	return VerifyIDTokenWithOptionsContext(context.Background(), keys, idToken, opts)
+}
+
+// VerifyIDTokenWithOptionsContext is VerifyIDTokenWithOptions with a
+// context bounding the fetch of Apple's keys, if one is needed.
+func VerifyIDTokenWithOptionsContext(ctx context.Context, keys *KeySet, idToken string, opts IDTokenOptions) (*AppleUser, error) {
+	if len(opts.Audiences) == 0 {
+		return nil, errors.New("id token options have no audiences")
+	}
+
+	claims, err := parseIDToken(ctx, keys, idToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.validate(claims); err != nil {
+		return nil, err
+	}
+	return userFromClaims(claims), nil
+}
+
+// parseIDToken verifies the RS256 signature of idToken and returns its
+// claims without validating them.
+func parseIDToken(ctx context.Context, keys *KeySet, idToken string) (gojwt.MapClaims, error) {
+	parser := gojwt.Parser{
+		ValidMethods:         []string{gojwt.SigningMethodRS256.Alg()},
+		SkipClaimsValidation: true,
+	}
+	token, err := parser.Parse(idToken, func(token *gojwt.Token) (interface{}, error) {
+		kid, ok := token.Header["kid"].(string)
+		if !ok || kid == "" {
+			return nil, &IDTokenError{Code: IDTokenErrorUnknownKey, Reason: "missing kid header"}
+		}
+		return keys.KeyContext(ctx, kid)
+	})
+	if err != nil {
+		var vErr *gojwt.ValidationError
+		if errors.As(err, &vErr) {
+			switch {
+			case vErr.Errors&gojwt.ValidationErrorMalformed != 0:
+				return nil, &IDTokenError{Code: IDTokenErrorMalformed, Reason: err.Error()}
+			case vErr.Errors&gojwt.ValidationErrorUnverifiable != 0:
+				// A missing or unknown key ID is the token's fault; any
+				// other key lookup error means the keys could not be fetched.
+				var idErr *IDTokenError
+				if errors.As(vErr.Inner, &idErr) {
+					return nil, idErr
+				}
+				return nil, &IDTokenError{Code: IDTokenErrorUnverifiable, Reason: err.Error()}
+			}
+		}
+		return nil, &IDTokenError{Code: IDTokenErrorInvalidSignature, Reason: err.Error()}
+	}
+
+	claims, ok := token.Claims.(gojwt.MapClaims)
+	if !ok {
+		return nil, &IDTokenError{Code: IDTokenErrorMalformed, Reason: "unexpected claims type"}
+	}
+	return claims, nil
+}
+
+// validate checks the iss, aud, exp, iat and nonce claims.
+func (o IDTokenOptions) validate(claims gojwt.MapClaims) error {
+	now := time.Now()
+	if o.Now != nil {
+		now = o.Now()
+	}
+
+	if iss, _ := claims["iss"].(string); iss != appleAudience {
+		return &IDTokenError{Code: IDTokenErrorInvalidIssuer, Reason: fmt.Sprintf("unexpected issuer %q", iss)}
+	}
+
+	if !audienceMatches(claims["aud"], o.Audiences) {
+		return &IDTokenError{Code: IDTokenErrorInvalidAudience, Reason: fmt.Sprintf("unexpected audience %v", claims["aud"])}
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return &IDTokenError{Code: IDTokenErrorMalformed, Reason: "missing exp claim"}
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(o.ClockSkew)) {
+		return &IDTokenError{Code: IDTokenErrorExpired, Reason: "token expired"}
+	}
+
+	iat, ok := claims["iat"].(float64)
+	if ok {
+		issuedAt := time.Unix(int64(iat), 0)
+		if issuedAt.After(now.Add(o.ClockSkew)) {
+			return &IDTokenError{Code: IDTokenErrorIssuedInFuture, Reason: "token used before issued"}
+		}
+		if o.MaxAge > 0 && now.Sub(issuedAt) > o.MaxAge+o.ClockSkew {
+			return &IDTokenError{Code: IDTokenErrorTooOld, Reason: "token exceeds max age"}
+		}
+	} else if o.MaxAge > 0 {
+		return &IDTokenError{Code: IDTokenErrorMalformed, Reason: "missing iat claim"}
+	}
+
+	if o.Nonce != "" {
+		nonce, _ := claims["nonce"].(string)
+		if !nonceMatches(nonce, o.Nonce) {
+			return &IDTokenError{Code: IDTokenErrorNonceMismatch, Reason: "nonce does not match"}
+		}
+	}
+
+	return nil
+}
+
+// audienceMatches reports whether the aud claim, a string or an array of
+// strings, contains one of the allowed audiences.
+func audienceMatches(aud interface{}, allowed []string) bool {
+	var values []string
+	switch v := aud.(type) {
+	case string:
+		values = []string{v}
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	for _, v := range values {
+		for _, a := range allowed {
+			if v == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nonceMatches compares the nonce claim against the raw expected nonce and
+// its hex-encoded SHA-256 hash.
+func nonceMatches(claim, expected string) bool {
+	if claim == "" {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(claim), []byte(expected)) == 1 {
+		return true
+	}
+	hash := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare([]byte(claim), []byte(hex.EncodeToString(hash[:]))) == 1
+}
@@ -0,0 +1,236 @@
+package apple
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const appleKeysEndpoint = appleIDBaseURL + "/auth/keys"
+
+type keySetHTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// KeySet fetches and caches the public keys Apple uses to sign ID tokens.
+// The cached set is re-fetched once RefreshInterval has elapsed, or when a
+// token references a key ID that is not in the cached set.
+// A KeySet is safe for concurrent use.
+type KeySet struct {
+	// Endpoint is the JWKS URL the keys are fetched from.
+	Endpoint string
+	// RefreshInterval is how long a fetched key set is used before it is
+	// fetched again.
+	RefreshInterval time.Duration
+	// MinRefreshInterval is the minimum time between two fetches. It stops
+	// tokens with unknown key IDs from hammering the endpoint.
+	MinRefreshInterval time.Duration
+
+	httpClient  keySetHTTPClient
+	now         func() time.Time
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	inflight    *keyFetch
+}
+
+// jwk is a single RSA JSON Web Key as published by Apple.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// jwkSet is the JSON Web Key Set document served by the keys endpoint.
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// NewKeySet creates a KeySet reading from the given JWKS endpoint. An empty
+// endpoint uses Apple's https://appleid.apple.com/auth/keys, moved to the
+// base URL given with WithBaseURL, if any.
+func NewKeySet(endpoint string, opts ...Option) *KeySet {
+	o := newClientOptions(10*time.Second, opts)
+	if endpoint == "" {
+		endpoint = rebaseURL(appleKeysEndpoint, appleIDBaseURL, o.baseURL)
+	}
+	return &KeySet{
+		Endpoint:           endpoint,
+		RefreshInterval:    24 * time.Hour,
+		MinRefreshInterval: time.Minute,
+		httpClient:         o.client(),
+		now:                o.now,
+	}
+}
+
+// Key returns the public key for the given key ID like KeyContext, without
+// a deadline other than the HTTP client timeout.
+func (k *KeySet) Key(kid string) (*rsa.PublicKey, error) {
+	return k.KeyContext(context.Background(), kid)
+}
+
+// KeyContext returns the public key for the given key ID, fetching the key
+// set if the cache is empty, stale, or does not contain the key. A key ID
+// missing from a fetched set is reported as an *IDTokenError with code
+// IDTokenErrorUnknownKey; other errors mean the set could not be fetched.
+// Concurrent callers share a single fetch, and each stops waiting for it
+// when its ctx is done.
+func (k *KeySet) KeyContext(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	now := time.Now()
+	if k.now != nil {
+		now = k.now()
+	}
+
+	k.mu.Lock()
+	stale := k.keys == nil || now.Sub(k.fetchedAt) >= k.RefreshInterval
+	k.mu.Unlock()
+	if stale {
+		// A failed refresh keeps serving the previous keys, if any.
+		if err := k.refresh(ctx, now); err != nil && !k.hasKeys() {
+			return nil, err
+		}
+	}
+
+	k.mu.Lock()
+	key, ok := k.keys[kid]
+	retry := now.Sub(k.attemptedAt) >= k.MinRefreshInterval
+	k.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	// Apple may have rotated its keys since the last fetch.
+	if retry {
+		if err := k.refresh(ctx, now); err != nil {
+			return nil, err
+		}
+		k.mu.Lock()
+		key, ok = k.keys[kid]
+		k.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+
+	return nil, &IDTokenError{Code: IDTokenErrorUnknownKey, Reason: "unknown key id: " + kid}
+}
+
+func (k *KeySet) hasKeys() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.keys != nil
+}
+
+// keyFetch is a fetch of the key set shared by concurrent callers. err is
+// set before done is closed.
+type keyFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// refresh fetches the key set and replaces the cached keys, joining the
+// fetch already in flight, if any. The fetch itself is not cancelled with
+// ctx, so that other callers waiting for it are not failed.
+func (k *KeySet) refresh(ctx context.Context, now time.Time) error {
+	k.mu.Lock()
+	f := k.inflight
+	if f == nil {
+		f = &keyFetch{done: make(chan struct{})}
+		k.inflight = f
+		k.attemptedAt = now
+		go k.fetch(context.WithoutCancel(ctx), f, now)
+	}
+	k.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetch runs f and stores the fetched keys.
+func (k *KeySet) fetch(ctx context.Context, f *keyFetch, now time.Time) {
+	keys, err := k.fetchKeys(ctx)
+
+	k.mu.Lock()
+	if err == nil {
+		k.keys = keys
+		k.fetchedAt = now
+	}
+	k.inflight = nil
+	k.mu.Unlock()
+
+	f.err = err
+	close(f.done)
+}
+
+// fetchKeys downloads and decodes the key set.
+func (k *KeySet) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", k.Endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code fetching keys: %d", resp.StatusCode)
+	}
+
+	var set jwkSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" {
+			continue
+		}
+		pub, err := key.rsaPublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", key.Kid, err)
+		}
+		keys[key.Kid] = pub
+	}
+	return keys, nil
+}
+
+// rsaPublicKey decodes the base64url modulus and exponent of the key.
+func (j jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(j.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(j.E)
+	if err != nil {
+		return nil, err
+	}
+	if len(n) == 0 || len(e) == 0 {
+		return nil, errors.New("empty modulus or exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
@@ -0,0 +1,183 @@
+package apple
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gojwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// testJWKSServer serves a JWKS document for a set of generated RSA keys.
+type testJWKSServer struct {
+	server *httptest.Server
+	keys   map[string]*rsa.PrivateKey
+	hits   int32
+}
+
+func newTestJWKSServer(t *testing.T, kids ...string) *testJWKSServer {
+	t.Helper()
+
+	s := &testJWKSServer{keys: make(map[string]*rsa.PrivateKey)}
+	for _, kid := range kids {
+		s.addKey(t, kid)
+	}
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.hits, 1)
+		var set jwkSet
+		for kid, key := range s.keys {
+			set.Keys = append(set.Keys, jwk{
+				Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				Alg: "RS256",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+func (s *testJWKSServer) addKey(t *testing.T, kid string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	s.keys[kid] = key
+}
+
+// sign creates an RS256 JWT with the given claims using the key with kid.
+func (s *testJWKSServer) sign(t *testing.T, kid string, claims gojwt.MapClaims) string {
+	t.Helper()
+	token := gojwt.NewWithClaims(gojwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(s.keys[kid])
+	assert.NoError(t, err)
+	return signed
+}
+
+func TestNewKeySetDefaultEndpoint(t *testing.T) {
+	ks := NewKeySet("")
+	assert.Equal(t, appleKeysEndpoint, ks.Endpoint)
+}
+
+func TestKeySetKey(t *testing.T) {
+	srv := newTestJWKSServer(t, "kid1")
+	ks := NewKeySet(srv.server.URL)
+
+	key, err := ks.Key("kid1")
+	assert.NoError(t, err)
+	assert.Equal(t, srv.keys["kid1"].PublicKey.N, key.N)
+	assert.Equal(t, srv.keys["kid1"].PublicKey.E, key.E)
+
+	// Second lookup is served from the cache.
+	_, err = ks.Key("kid1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&srv.hits))
+}
+
+func TestKeySetRefetchOnUnknownKid(t *testing.T) {
+	srv := newTestJWKSServer(t, "kid1")
+	ks := NewKeySet(srv.server.URL)
+	ks.MinRefreshInterval = 0
+
+	_, err := ks.Key("kid1")
+	assert.NoError(t, err)
+
+	srv.addKey(t, "kid2")
+	key, err := ks.Key("kid2")
+	assert.NoError(t, err)
+	assert.NotNil(t, key)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&srv.hits))
+}
+
+func TestKeySetUnknownKidRateLimited(t *testing.T) {
+	srv := newTestJWKSServer(t, "kid1")
+	ks := NewKeySet(srv.server.URL)
+
+	_, err := ks.Key("missing")
+	assert.Error(t, err)
+	_, err = ks.Key("missing")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&srv.hits))
+}
+
+func TestKeySetRefreshInterval(t *testing.T) {
+	srv := newTestJWKSServer(t, "kid1")
+	ks := NewKeySet(srv.server.URL)
+
+	_, err := ks.Key("kid1")
+	assert.NoError(t, err)
+
+	ks.fetchedAt = time.Now().Add(-25 * time.Hour)
+	_, err = ks.Key("kid1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&srv.hits))
+}
+
+func TestKeySetServerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	ks := NewKeySet(srv.URL)
+	_, err := ks.Key("kid1")
+	assert.Error(t, err)
+}
+
+func TestKeySetKeyContext(t *testing.T) {
+	srv := newTestJWKSServer(t, "kid1")
+	block := make(chan struct{})
+	var hits int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-block
+		res, err := http.Get(srv.server.URL)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer func() { _ = res.Body.Close() }()
+		_, _ = io.Copy(w, res.Body)
+	}))
+	defer slow.Close()
+	ks := NewKeySet(slow.URL)
+
+	// Callers waiting on a slow endpoint give up with their own context and
+	// share a single fetch.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := ks.KeyContext(ctx, "kid1")
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		}()
+	}
+	wg.Wait()
+
+	close(block)
+	key, err := ks.Key("kid1")
+	assert.NoError(t, err)
+	assert.Equal(t, srv.keys["kid1"].PublicKey.N, key.N)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
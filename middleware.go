@@ -0,0 +1,104 @@
+package apple
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type userContextKey struct{}
+
+// ContextWithUser returns a copy of ctx carrying user, as stored by
+// IDTokenMiddleware. It is useful to test protected handlers.
+func ContextWithUser(ctx context.Context, user *AppleUser) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// UserFromContext returns the user verified by IDTokenMiddleware.
+func UserFromContext(ctx context.Context) (*AppleUser, bool) {
+	user, ok := ctx.Value(userContextKey{}).(*AppleUser)
+	return user, ok && user != nil
+}
+
+// IDTokenMiddleware protects HTTP handlers with Apple ID tokens sent as
+// bearer tokens in the Authorization header. The verified *AppleUser is
+// available to the wrapped handler through UserFromContext.
+//
+// Requests without a token are answered with 401, invalid tokens with 401
+// and error="invalid_token", malformed headers with 400 and
+// error="invalid_request", following RFC 6750. When the keys cannot be
+// fetched the reply is 503. Without Options.Audiences every request is
+// answered with 500, since any app's tokens would be accepted otherwise.
+type IDTokenMiddleware struct {
+	// Keys verifies the token signatures. Required.
+	Keys *KeySet
+	// Options configures the token checks. Options.Audiences lists the
+	// client IDs of the apps allowed to call the API. Required.
+	Options IDTokenOptions
+	// Realm is sent in the WWW-Authenticate header. Defaults to "apple".
+	Realm string
+}
+
+// Wrap returns a handler that verifies the token and calls next.
+func (m *IDTokenMiddleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(m.Options.Audiences) == 0 {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			m.challenge(w, http.StatusUnauthorized, "", "")
+			return
+		}
+
+		scheme, token, ok := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			m.challenge(w, http.StatusUnauthorized, "", "")
+			return
+		}
+		token = strings.TrimSpace(token)
+		if !ok || token == "" {
+			m.challenge(w, http.StatusBadRequest, "invalid_request", "missing bearer token")
+			return
+		}
+
+		user, err := VerifyIDTokenWithOptionsContext(r.Context(), m.Keys, token, m.Options)
+		if err != nil {
+			var idErr *IDTokenError
+			if errors.As(err, &idErr) && idErr.Code == IDTokenErrorUnverifiable {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			description := "invalid token"
+			if idErr != nil {
+				description = strings.ToLower(strings.ReplaceAll(string(idErr.Code), "_", " "))
+			}
+			m.challenge(w, http.StatusUnauthorized, "invalid_token", description)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(ContextWithUser(r.Context(), user)))
+	})
+}
+
+// challenge replies with status and a Bearer WWW-Authenticate header.
+func (m *IDTokenMiddleware) challenge(w http.ResponseWriter, status int, errorCode, description string) {
+	realm := m.Realm
+	if realm == "" {
+		realm = "apple"
+	}
+
+	value := fmt.Sprintf("Bearer realm=%q", realm)
+	if errorCode != "" {
+		value += fmt.Sprintf(", error=%q", errorCode)
+	}
+	if description != "" {
+		value += fmt.Sprintf(", error_description=%q", description)
+	}
+	w.Header().Set("WWW-Authenticate", value)
+	http.Error(w, http.StatusText(status), status)
+}
@@ -0,0 +1,121 @@
+package apple
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gojwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDTokenMiddleware(t *testing.T) {
+	srv := newTestJWKSServer(t, "kid1")
+	m := &IDTokenMiddleware{
+		Keys:    NewKeySet(srv.server.URL),
+		Options: IDTokenOptions{Audiences: []string{"com.example.app"}},
+	}
+
+	var user *AppleUser
+	h := m.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ = UserFromContext(r.Context())
+	}))
+
+	expired := testIDTokenClaims(time.Now())
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	otherAudience := testIDTokenClaims(time.Now())
+	otherAudience["aud"] = "com.example.other"
+	unknownKey := newTestJWKSServer(t, "kid9").sign(t, "kid9", testIDTokenClaims(time.Now()))
+	noKid, err := gojwt.NewWithClaims(gojwt.SigningMethodRS256, testIDTokenClaims(time.Now())).SignedString(srv.keys["kid1"])
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+		challenge     string
+	}{
+		{"valid", "Bearer " + srv.sign(t, "kid1", testIDTokenClaims(time.Now())), http.StatusOK, ""},
+		{"lowercase scheme", "bearer " + srv.sign(t, "kid1", testIDTokenClaims(time.Now())), http.StatusOK, ""},
+		{"missing header", "", http.StatusUnauthorized, `Bearer realm="apple"`},
+		{"other scheme", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, `Bearer realm="apple"`},
+		{"empty token", "Bearer ", http.StatusBadRequest, `Bearer realm="apple", error="invalid_request", error_description="missing bearer token"`},
+		{"malformed", "Bearer not-a-jwt", http.StatusUnauthorized, `Bearer realm="apple", error="invalid_token", error_description="malformed"`},
+		{"expired", "Bearer " + srv.sign(t, "kid1", expired), http.StatusUnauthorized, `Bearer realm="apple", error="invalid_token", error_description="expired"`},
+		{"other audience", "Bearer " + srv.sign(t, "kid1", otherAudience), http.StatusUnauthorized, `Bearer realm="apple", error="invalid_token", error_description="invalid audience"`},
+		{"unknown kid", "Bearer " + unknownKey, http.StatusUnauthorized, `Bearer realm="apple", error="invalid_token", error_description="unknown key"`},
+		{"missing kid", "Bearer " + noKid, http.StatusUnauthorized, `Bearer realm="apple", error="invalid_token", error_description="unknown key"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user = nil
+			req := httptest.NewRequest("GET", "/api", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Equal(t, tt.challenge, rec.Header().Get("WWW-Authenticate"))
+			if tt.status == http.StatusOK {
+				if assert.NotNil(t, user) {
+					assert.Equal(t, "001234.abcd", user.Subject)
+				}
+			} else {
+				assert.Nil(t, user)
+			}
+		})
+	}
+}
+
+func TestIDTokenMiddlewareKeysUnavailable(t *testing.T) {
+	keysSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer keysSrv.Close()
+	srv := newTestJWKSServer(t, "kid1")
+
+	m := &IDTokenMiddleware{
+		Keys:    NewKeySet(keysSrv.URL),
+		Options: IDTokenOptions{Audiences: []string{"com.example.app"}},
+		Realm:   "internal",
+	}
+	h := m.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler must not be called")
+	}))
+
+	req := httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set("Authorization", "Bearer "+srv.sign(t, "kid1", testIDTokenClaims(time.Now())))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Empty(t, rec.Header().Get("WWW-Authenticate"))
+}
+
+func TestIDTokenMiddlewareRequiresAudiences(t *testing.T) {
+	srv := newTestJWKSServer(t, "kid1")
+	m := &IDTokenMiddleware{Keys: NewKeySet(srv.server.URL)}
+	h := m.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler must not be called")
+	}))
+
+	req := httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set("Authorization", "Bearer "+srv.sign(t, "kid1", testIDTokenClaims(time.Now())))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestUserFromContext(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	_, ok := UserFromContext(req.Context())
+	assert.False(t, ok)
+
+	user := &AppleUser{Subject: "001234.abcd"}
+	got, ok := UserFromContext(ContextWithUser(req.Context(), user))
+	assert.True(t, ok)
+	assert.Same(t, user, got)
+}
@@ -0,0 +1,145 @@
+package apple
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Option configures a client created by one of the constructors, e.g. New,
+// NewAppStoreServerAPI, NewCloudKit or NewKeySet.
+type Option func(*clientOptions)
+
+type clientOptions struct {
+	// defaultTimeout is the timeout of the client created when neither
+	// WithHTTPClient nor WithTimeout was given.
+	defaultTimeout time.Duration
+
+	httpClient *http.Client
+	baseURL    string
+	timeout    time.Duration
+	userAgent  string
+	now        func() time.Time
+	logger     *slog.Logger
+}
+
+// WithHTTPClient makes the client send its requests through c, e.g. to use
+// a custom transport or proxy.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *clientOptions) {
+		o.httpClient = c
+	}
+}
+
+// WithBaseURL replaces the scheme and host of Apple's endpoints, e.g. with
+// the URL of a local test server. The paths are kept.
+func WithBaseURL(baseURL string) Option {
+	return func(o *clientOptions) {
+		o.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithTimeout sets the timeout of each request. It also applies to a client
+// given with WithHTTPClient.
+func WithTimeout(d time.Duration) Option {
+	return func(o *clientOptions) {
+		o.timeout = d
+	}
+}
+
+// WithUserAgent sets the User-Agent header of every request.
+func WithUserAgent(userAgent string) Option {
+	return func(o *clientOptions) {
+		o.userAgent = userAgent
+	}
+}
+
+// WithClock replaces time.Now for issuing and caching tokens and signing
+// requests.
+func WithClock(now func() time.Time) Option {
+	return func(o *clientOptions) {
+		o.now = now
+	}
+}
+
+// WithLogger logs every request at debug level and failed round trips at
+// warn level. Request bodies and headers are never logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *clientOptions) {
+		o.logger = logger
+	}
+}
+
+// newClientOptions applies opts on top of the client defaults.
+func newClientOptions(defaultTimeout time.Duration, opts []Option) *clientOptions {
+	o := &clientOptions{defaultTimeout: defaultTimeout, now: time.Now}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// client returns the HTTP client for the options, wrapped to set the user
+// agent and log requests when requested.
+func (o *clientOptions) client() httpClient {
+	c := o.httpClient
+	if c == nil {
+		timeout := o.timeout
+		if timeout <= 0 {
+			timeout = o.defaultTimeout
+		}
+		c = &http.Client{Timeout: timeout}
+	} else if o.timeout > 0 && c.Timeout != o.timeout {
+		copied := *c
+		copied.Timeout = o.timeout
+		c = &copied
+	}
+
+	if o.userAgent == "" && o.logger == nil {
+		return c
+	}
+	return &instrumentedClient{next: c, userAgent: o.userAgent, logger: o.logger}
+}
+
+// rebaseURL moves endpoint from appleBaseURL to baseURL. An empty baseURL
+// keeps endpoint.
+func rebaseURL(endpoint, appleBaseURL, baseURL string) string {
+	if baseURL == "" {
+		return endpoint
+	}
+	return baseURL + strings.TrimPrefix(endpoint, appleBaseURL)
+}
+
+// instrumentedClient sets the User-Agent header and logs requests.
+type instrumentedClient struct {
+	next      httpClient
+	userAgent string
+	logger    *slog.Logger
+}
+
+func (c *instrumentedClient) Do(req *http.Request) (*http.Response, error) {
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+
+	start := time.Now()
+	res, err := c.next.Do(req)
+	if c.logger == nil {
+		return res, err
+	}
+
+	// The query is left out since it can hold tokens.
+	attrs := []any{
+		slog.String("method", req.Method),
+		slog.String("host", req.URL.Host),
+		slog.String("path", req.URL.Path),
+		slog.Duration("duration", time.Since(start)),
+	}
+	if err != nil {
+		c.logger.WarnContext(req.Context(), "apple: request failed", append(attrs, slog.Any("error", err))...)
+		return res, err
+	}
+	c.logger.DebugContext(req.Context(), "apple: request", append(attrs, slog.Int("status", res.StatusCode))...)
+	return res, nil
+}
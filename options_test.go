@@ -0,0 +1,125 @@
+package apple
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gojwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func testKeyB64() string {
+	return base64.StdEncoding.EncodeToString([]byte(testECPrivateKey))
+}
+
+func TestOptionsBaseURLAndUserAgent(t *testing.T) {
+	var paths, userAgents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		userAgents = append(userAgents, r.UserAgent())
+		switch r.URL.Path {
+		case "/auth/token":
+			_, _ = w.Write([]byte(`{"access_token":"access","token_type":"bearer","expires_in":3600}`))
+		case "/inApps/v1/notifications/test":
+			_, _ = w.Write([]byte(`{"testNotificationToken":"test-token"}`))
+		default:
+			_, _ = w.Write([]byte(`{"userRecordName":"_user"}`))
+		}
+	}))
+	defer srv.Close()
+
+	opts := []Option{WithBaseURL(srv.URL + "/"), WithUserAgent("example/1.0")}
+
+	auth, err := NewB64("com.example.app", "TEAM123456", "KEYID12345", testKeyB64(), opts...)
+	assert.NoError(t, err)
+	_, err = auth.ValidateRefreshToken("refresh-token")
+	assert.NoError(t, err)
+
+	api, err := NewAppStoreServerAPIB64("issuer", "KEYID12345", "com.example.app", testKeyB64(), false, opts...)
+	assert.NoError(t, err)
+	res, err := api.RequestTestNotification()
+	assert.NoError(t, err)
+	assert.Equal(t, "test-token", res.TestNotificationToken)
+
+	ck, err := NewCloudKitB64("KEYID12345", "iCloud.com.example.app", CKEnvironmentDevelopment, testKeyB64(), opts...)
+	assert.NoError(t, err)
+	_, err = ck.GetCurrentUser(CKDatabasePublic)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"/auth/token",
+		"/inApps/v1/notifications/test",
+		"/database/1/iCloud.com.example.app/development/public/users/current",
+	}, paths)
+	assert.Equal(t, []string{"example/1.0", "example/1.0", "example/1.0"}, userAgents)
+}
+
+func TestOptionsKeySetBaseURL(t *testing.T) {
+	srv := newTestJWKSServer(t, "kid1")
+
+	keys := NewKeySet("", WithBaseURL(srv.server.URL))
+	assert.Equal(t, srv.server.URL+"/auth/keys", keys.Endpoint)
+
+	// An explicit endpoint wins over the base URL.
+	keys = NewKeySet(srv.server.URL, WithBaseURL("https://example.com"))
+	assert.Equal(t, srv.server.URL, keys.Endpoint)
+}
+
+func TestOptionsClock(t *testing.T) {
+	fixed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	auth, err := NewB64("com.example.app", "TEAM123456", "KEYID12345", testKeyB64(), WithClock(func() time.Time { return fixed }))
+	assert.NoError(t, err)
+
+	secret, err := auth.ClientSecret()
+	assert.NoError(t, err)
+	token, _, err := new(gojwt.Parser).ParseUnverified(secret, &gojwt.StandardClaims{})
+	assert.NoError(t, err)
+	assert.Equal(t, fixed.Unix(), token.Claims.(*gojwt.StandardClaims).IssuedAt)
+
+	ck, err := NewCloudKitB64("KEYID12345", "iCloud.com.example.app", CKEnvironmentDevelopment, testKeyB64(), WithClock(func() time.Time { return fixed }))
+	assert.NoError(t, err)
+	date, _, err := ck.(*cloudKit).sign([]byte(`{}`), "/test")
+	assert.NoError(t, err)
+	assert.Equal(t, "2024-01-02T03:04:05Z", date)
+}
+
+func TestOptionsHTTPClientAndTimeout(t *testing.T) {
+	custom := &http.Client{Timeout: time.Minute}
+
+	o := newClientOptions(10*time.Second, []Option{WithHTTPClient(custom)})
+	assert.Same(t, custom, o.client())
+
+	o = newClientOptions(10*time.Second, []Option{WithHTTPClient(custom), WithTimeout(5 * time.Second)})
+	c := o.client().(*http.Client)
+	assert.Equal(t, 5*time.Second, c.Timeout)
+	// The given client is not modified.
+	assert.Equal(t, time.Minute, custom.Timeout)
+
+	o = newClientOptions(10*time.Second, nil)
+	assert.Equal(t, 10*time.Second, o.client().(*http.Client).Timeout)
+}
+
+func TestOptionsLogger(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"access_token":"access","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	auth, err := NewB64("com.example.app", "TEAM123456", "KEYID12345", testKeyB64(), WithBaseURL(srv.URL), WithLogger(logger))
+	assert.NoError(t, err)
+	_, err = auth.ValidateRefreshToken("refresh-token")
+	assert.NoError(t, err)
+
+	assert.Contains(t, buf.String(), "path=/auth/token")
+	assert.Contains(t, buf.String(), "status=200")
+	assert.NotContains(t, buf.String(), "refresh-token")
+}
@@ -0,0 +1,122 @@
+package apple
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// errNilSigner is returned by the constructors taking a Signer when it is nil.
+var errNilSigner = errors.New("signer is nil")
+
+// Signer signs with an Apple P-256 private key on behalf of the clients,
+// so the key itself can stay in a KMS or HSM. It is used for the ES256
+// client secrets and API tokens as well as for CloudKit request signatures.
+type Signer interface {
+	// KeyID returns the ID of the key in App Store Connect or the developer
+	// account.
+	KeyID() string
+	// Sign signs a SHA-256 digest and returns the ASN.1 DER encoded ECDSA
+	// signature.
+	Sign(digest []byte) ([]byte, error)
+}
+
+// cryptoSigner adapts a crypto.Signer holding a P-256 key.
+type cryptoSigner struct {
+	keyID  string
+	signer crypto.Signer
+	rand   io.Reader
+}
+
+// NewCryptoSigner adapts a crypto.Signer, e.g. one backed by a cloud KMS or
+// a PKCS#11 token, to a Signer. The public key must be an ECDSA P-256 key.
+func NewCryptoSigner(keyID string, signer crypto.Signer) (Signer, error) {
+	if signer == nil {
+		return nil, errNilSigner
+	}
+	pub, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok || pub.Curve != elliptic.P256() {
+		return nil, errors.New("signer key is not an ECDSA P-256 key")
+	}
+	return &cryptoSigner{keyID: keyID, signer: signer, rand: rand.Reader}, nil
+}
+
+// NewPEMSigner parses a PKCS#8 PEM encoded .p8 key and returns a Signer
+// keeping it in memory.
+func NewPEMSigner(keyID string, keyContent []byte) (Signer, error) {
+	privateKey, err := parseECPrivateKey(keyContent)
+	if err != nil {
+		return nil, err
+	}
+	return NewCryptoSigner(keyID, privateKey)
+}
+
+// KeyID implements Signer.
+func (s *cryptoSigner) KeyID() string {
+	return s.keyID
+}
+
+// Sign implements Signer.
+func (s *cryptoSigner) Sign(digest []byte) ([]byte, error) {
+	return s.signer.Sign(s.rand, digest, crypto.SHA256)
+}
+
+// signerMethod is the ES256 jwt.SigningMethod for a Signer. It only signs
+// and is deliberately not registered, so parsing tokens is unaffected.
+type signerMethod struct{}
+
+func (signerMethod) Alg() string {
+	return "ES256"
+}
+
+func (signerMethod) Verify(signingString, signature string, key interface{}) error {
+	return errors.New("verification is not supported")
+}
+
+func (signerMethod) Sign(signingString string, key interface{}) (string, error) {
+	signer, ok := key.(Signer)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	digest := sha256.Sum256([]byte(signingString))
+	der, err := signer.Sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// JWS wants the fixed size r || s form instead of DER.
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return "", fmt.Errorf("invalid signature: %w", err)
+	}
+	if sig.R == nil || sig.S == nil || sig.R.BitLen() > 256 || sig.S.BitLen() > 256 {
+		return "", errors.New("invalid signature: not a P-256 signature")
+	}
+	raw := make([]byte, 64)
+	sig.R.FillBytes(raw[:32])
+	sig.S.FillBytes(raw[32:])
+	return jwt.EncodeSegment(raw), nil
+}
+
+// signJWT signs claims as an ES256 JWT with signer, setting its key ID as
+// the kid header.
+func signJWT(signer Signer, claims jwt.Claims, header map[string]interface{}) (string, error) {
+	token := jwt.NewWithClaims(signerMethod{}, claims)
+	for k, v := range header {
+		token.Header[k] = v
+	}
+	token.Header["kid"] = signer.KeyID()
+	return token.SignedString(signer)
+}
@@ -0,0 +1,161 @@
+package apple
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	gojwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// kmsSigner stands in for a remote signer: it never exposes its key and
+// counts the signatures it made.
+type kmsSigner struct {
+	key   *ecdsa.PrivateKey
+	calls int
+	err   error
+}
+
+func (s *kmsSigner) Public() crypto.PublicKey {
+	return &s.key.PublicKey
+}
+
+func (s *kmsSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return ecdsa.SignASN1(rand, s.key, digest)
+}
+
+func newTestKMSSigner(t *testing.T) (*kmsSigner, Signer) {
+	t.Helper()
+
+	key, err := parseECPrivateKey([]byte(testECPrivateKey))
+	assert.NoError(t, err)
+	kms := &kmsSigner{key: key}
+	signer, err := NewCryptoSigner("KMSKEY1234", kms)
+	assert.NoError(t, err)
+	return kms, signer
+}
+
+func TestPEMSigner(t *testing.T) {
+	signer, err := NewPEMSigner("KEYID12345", []byte(testECPrivateKey))
+	assert.NoError(t, err)
+	assert.Equal(t, "KEYID12345", signer.KeyID())
+
+	key, _ := parseECPrivateKey([]byte(testECPrivateKey))
+	digest := sha256.Sum256([]byte("message"))
+	sig, err := signer.Sign(digest[:])
+	assert.NoError(t, err)
+	assert.True(t, ecdsa.VerifyASN1(&key.PublicKey, digest[:], sig))
+
+	_, err = NewPEMSigner("KEYID12345", []byte("not-a-key"))
+	assert.Error(t, err)
+}
+
+func TestCryptoSignerRejectsNonP256(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	_, err = NewCryptoSigner("KEYID12345", rsaKey)
+	assert.Error(t, err)
+}
+
+func TestSignJWT(t *testing.T) {
+	_, signer := newTestKMSSigner(t)
+	key, _ := parseECPrivateKey([]byte(testECPrivateKey))
+
+	signed, err := signJWT(signer, &gojwt.StandardClaims{Issuer: "TEAM123456"}, map[string]interface{}{"typ": "JWT"})
+	assert.NoError(t, err)
+
+	token, err := gojwt.Parse(signed, func(token *gojwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ES256", token.Header["alg"])
+		assert.Equal(t, "KMSKEY1234", token.Header["kid"])
+		assert.Equal(t, "JWT", token.Header["typ"])
+		assert.Equal(t, "TEAM123456", token.Claims.(gojwt.MapClaims)["iss"])
+	}
+}
+
+func TestSignJWTSignerError(t *testing.T) {
+	kms, signer := newTestKMSSigner(t)
+	kms.err = errors.New("kms unavailable")
+
+	_, err := signJWT(signer, &gojwt.StandardClaims{}, nil)
+	assert.ErrorIs(t, err, kms.err)
+}
+
+func TestNewWithSigner(t *testing.T) {
+	kms, signer := newTestKMSSigner(t)
+
+	auth, err := NewWithSigner("com.example.app", "TEAM123456", signer)
+	assert.NoError(t, err)
+	assert.Empty(t, auth.KeyContent)
+
+	secret, err := auth.ClientSecret()
+	assert.NoError(t, err)
+	token, _, err := new(gojwt.Parser).ParseUnverified(secret, &gojwt.StandardClaims{})
+	assert.NoError(t, err)
+	assert.Equal(t, "KMSKEY1234", token.Header["kid"])
+
+	// The secret is cached, so the signer is only asked once.
+	_, err = auth.ClientSecret()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, kms.calls)
+}
+
+func TestCloudKitWithSigner(t *testing.T) {
+	_, signer := newTestKMSSigner(t)
+	key, _ := parseECPrivateKey([]byte(testECPrivateKey))
+
+	ck, err := NewCloudKitWithSigner("iCloud.com.example.app", CKEnvironmentDevelopment, signer)
+	assert.NoError(t, err)
+
+	body := []byte(`{}`)
+	date, signature, err := ck.(*cloudKit).sign(body, "/database/1/test")
+	assert.NoError(t, err)
+
+	bodyHash := sha256.Sum256(body)
+	message := fmt.Sprintf("%s:%s:%s", date, base64.StdEncoding.EncodeToString(bodyHash[:]), "/database/1/test")
+	messageHash := sha256.Sum256([]byte(message))
+	sig, _ := base64.StdEncoding.DecodeString(signature)
+	assert.True(t, ecdsa.VerifyASN1(&key.PublicKey, messageHash[:], sig))
+}
+
+func TestAppStoreServerAPIWithSigner(t *testing.T) {
+	_, signer := newTestKMSSigner(t)
+
+	api, err := NewAppStoreServerAPIWithSigner("issuer-id", "com.example.app", signer, true)
+	assert.NoError(t, err)
+
+	signed, err := api.(*appStoreServer).generateToken()
+	assert.NoError(t, err)
+	token, _, err := new(gojwt.Parser).ParseUnverified(signed, gojwt.MapClaims{})
+	assert.NoError(t, err)
+	assert.Equal(t, "KMSKEY1234", token.Header["kid"])
+	assert.Equal(t, "com.example.app", token.Claims.(gojwt.MapClaims)["bid"])
+}
+
+func TestNilSigner(t *testing.T) {
+	_, err := NewWithSigner("com.example.app", "TEAM123456", nil)
+	assert.ErrorIs(t, err, errNilSigner)
+	_, err = NewCloudKitWithSigner("iCloud.com.example.app", CKEnvironmentDevelopment, nil)
+	assert.ErrorIs(t, err, errNilSigner)
+	_, err = NewAppStoreServerAPIWithSigner("issuer-id", "com.example.app", nil, true)
+	assert.ErrorIs(t, err, errNilSigner)
+	_, err = NewMultiClientWithSigner([]string{"com.example.app"}, "TEAM123456", nil)
+	assert.ErrorIs(t, err, errNilSigner)
+	_, err = NewCryptoSigner("KMSKEY1234", nil)
+	assert.ErrorIs(t, err, errNilSigner)
+}
@@ -0,0 +1,180 @@
+package apple
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// SignInEventType represents the type of a Sign in with Apple
+// server-to-server notification event.
+type SignInEventType string
+
+const (
+	SignInEventEmailDisabled  SignInEventType = "email-disabled"
+	SignInEventEmailEnabled   SignInEventType = "email-enabled"
+	SignInEventConsentRevoked SignInEventType = "consent-revoked"
+	SignInEventAccountDelete  SignInEventType = "account-delete"
+)
+
+// SignInNotification is a verified Sign in with Apple server-to-server
+// notification.
+type SignInNotification struct {
+	Issuer   string      `json:"iss"`
+	Audience string      `json:"aud"`
+	IssuedAt time.Time   `json:"iat"`
+	JWTID    string      `json:"jti"`
+	Event    SignInEvent `json:"events"`
+}
+
+// SignInEvent describes the change to a user's account.
+type SignInEvent struct {
+	Type           SignInEventType `json:"type"`
+	Subject        string          `json:"sub"`
+	Email          string          `json:"email,omitempty"`
+	IsPrivateEmail bool            `json:"is_private_email,omitempty"`
+	EventTime      time.Time       `json:"event_time"`
+}
+
+// signInNotificationBody is the JSON body Apple posts to the endpoint.
+type signInNotificationBody struct {
+	Payload string `json:"payload"`
+}
+
+// ParseSignInNotification verifies the payload JWT of a Sign in with Apple
+// server-to-server notification against keys, checks that it was issued by
+// Apple for one of audiences, and decodes its events claim. Failures are
+// returned as *IDTokenError.
+func ParseSignInNotification(keys *KeySet, audiences []string, body []byte) (*SignInNotification, error) {
+	return ParseSignInNotificationContext(context.Background(), keys, audiences, body)
+}
+
+// ParseSignInNotificationContext is ParseSignInNotification with a context
+// bounding the fetch of Apple's keys, if one is needed.
+func ParseSignInNotificationContext(ctx context.Context, keys *KeySet, audiences []string, body []byte) (*SignInNotification, error) {
+	var envelope signInNotificationBody
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, &IDTokenError{Code: IDTokenErrorMalformed, Reason: err.Error()}
+	}
+	if envelope.Payload == "" {
+		return nil, &IDTokenError{Code: IDTokenErrorMalformed, Reason: "missing payload"}
+	}
+
+	claims, err := parseIDToken(ctx, keys, envelope.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != appleAudience {
+		return nil, &IDTokenError{Code: IDTokenErrorInvalidIssuer, Reason: fmt.Sprintf("unexpected issuer %q", iss)}
+	}
+	if !audienceMatches(claims["aud"], audiences) {
+		return nil, &IDTokenError{Code: IDTokenErrorInvalidAudience, Reason: fmt.Sprintf("unexpected audience %v", claims["aud"])}
+	}
+
+	n := SignInNotification{Issuer: appleAudience}
+	n.Audience, _ = claims["aud"].(string)
+	n.JWTID, _ = claims["jti"].(string)
+	if v, ok := claims["iat"].(float64); ok {
+		n.IssuedAt = time.Unix(int64(v), 0)
+	}
+
+	// Apple sends the events claim as a JSON encoded string.
+	var eventClaims map[string]interface{}
+	switch v := claims["events"].(type) {
+	case string:
+		if err := json.Unmarshal([]byte(v), &eventClaims); err != nil {
+			return nil, &IDTokenError{Code: IDTokenErrorMalformed, Reason: "invalid events claim: " + err.Error()}
+		}
+	case map[string]interface{}:
+		eventClaims = v
+	default:
+		return nil, &IDTokenError{Code: IDTokenErrorMalformed, Reason: "missing events claim"}
+	}
+
+	if v, ok := eventClaims["type"].(string); ok {
+		n.Event.Type = SignInEventType(v)
+	}
+	if v, ok := eventClaims["sub"].(string); ok {
+		n.Event.Subject = v
+	}
+	if v, ok := eventClaims["email"].(string); ok {
+		n.Event.Email = v
+	}
+	n.Event.IsPrivateEmail = parseBool(eventClaims, "is_private_email")
+	if v, ok := eventClaims["event_time"].(float64); ok {
+		// event_time is in milliseconds.
+		n.Event.EventTime = time.UnixMilli(int64(v))
+	}
+
+	return &n, nil
+}
+
+// SignInNotificationHandler is an http.Handler for the Sign in with Apple
+// server-to-server notification endpoint. It verifies each notification
+// and dispatches it to the callback of its event type. Verification
+// failures are answered with 400, callback errors and unreachable keys with
+// 5xx so that Apple retries the delivery. Events without a callback are acknowledged.
+type SignInNotificationHandler struct {
+	// Keys verifies the payload signature. Required.
+	Keys *KeySet
+	// Audiences lists the client IDs the notifications are accepted for.
+	// Required.
+	Audiences []string
+
+	OnEmailDisabled  func(r *http.Request, n *SignInNotification) error
+	OnEmailEnabled   func(r *http.Request, n *SignInNotification) error
+	OnConsentRevoked func(r *http.Request, n *SignInNotification) error
+	OnAccountDelete  func(r *http.Request, n *SignInNotification) error
+}
+
+// ServeHTTP implements http.Handler.
+func (h *SignInNotificationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCallbackBodySize))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	n, err := ParseSignInNotificationContext(r.Context(), h.Keys, h.Audiences, body)
+	if err != nil {
+		status := http.StatusBadRequest
+		// Only a failed key fetch is worth a retry. A missing or unknown
+		// key ID is reported as IDTokenErrorUnknownKey and rejected.
+		var idErr *IDTokenError
+		if errors.As(err, &idErr) && idErr.Code == IDTokenErrorUnverifiable {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	var callback func(r *http.Request, n *SignInNotification) error
+	switch n.Event.Type {
+	case SignInEventEmailDisabled:
+		callback = h.OnEmailDisabled
+	case SignInEventEmailEnabled:
+		callback = h.OnEmailEnabled
+	case SignInEventConsentRevoked:
+		callback = h.OnConsentRevoked
+	case SignInEventAccountDelete:
+		callback = h.OnAccountDelete
+	}
+
+	if callback != nil {
+		if err := callback(r, n); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,131 @@
+package apple
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gojwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSignInNotificationBody(t *testing.T, srv *testJWKSServer, aud string, event map[string]interface{}) []byte {
+	t.Helper()
+
+	events, err := json.Marshal(event)
+	assert.NoError(t, err)
+
+	payload := srv.sign(t, "kid1", gojwt.MapClaims{
+		"iss":    appleAudience,
+		"aud":    aud,
+		"iat":    time.Now().Unix(),
+		"jti":    "jti-1",
+		"events": string(events),
+	})
+	body, err := json.Marshal(signInNotificationBody{Payload: payload})
+	assert.NoError(t, err)
+	return body
+}
+
+func TestParseSignInNotification(t *testing.T) {
+	srv := newTestJWKSServer(t, "kid1")
+	body := testSignInNotificationBody(t, srv, "com.example.app", map[string]interface{}{
+		"type":             "email-disabled",
+		"sub":              "001234.abcd",
+		"email":            "abc@privaterelay.appleid.com",
+		"is_private_email": "true",
+		"event_time":       1700000000123,
+	})
+
+	n, err := ParseSignInNotification(NewKeySet(srv.server.URL), []string{"com.example.app"}, body)
+	assert.NoError(t, err)
+	assert.Equal(t, "com.example.app", n.Audience)
+	assert.Equal(t, "jti-1", n.JWTID)
+	assert.Equal(t, SignInEventEmailDisabled, n.Event.Type)
+	assert.Equal(t, "001234.abcd", n.Event.Subject)
+	assert.Equal(t, "abc@privaterelay.appleid.com", n.Event.Email)
+	assert.True(t, n.Event.IsPrivateEmail)
+	assert.Equal(t, time.UnixMilli(1700000000123), n.Event.EventTime)
+}
+
+func TestParseSignInNotification_WrongAudience(t *testing.T) {
+	srv := newTestJWKSServer(t, "kid1")
+	body := testSignInNotificationBody(t, srv, "com.other.app", map[string]interface{}{"type": "account-delete", "sub": "x"})
+
+	_, err := ParseSignInNotification(NewKeySet(srv.server.URL), []string{"com.example.app"}, body)
+	assertIDTokenError(t, err, IDTokenErrorInvalidAudience)
+}
+
+func TestParseSignInNotification_Forged(t *testing.T) {
+	srv := newTestJWKSServer(t, "kid1")
+	other := newTestJWKSServer(t, "kid1")
+	body := testSignInNotificationBody(t, other, "com.example.app", map[string]interface{}{"type": "account-delete", "sub": "x"})
+
+	_, err := ParseSignInNotification(NewKeySet(srv.server.URL), []string{"com.example.app"}, body)
+	assertIDTokenError(t, err, IDTokenErrorInvalidSignature)
+}
+
+func TestParseSignInNotification_MissingPayload(t *testing.T) {
+	_, err := ParseSignInNotification(NewKeySet(""), []string{"com.example.app"}, []byte(`{}`))
+	assertIDTokenError(t, err, IDTokenErrorMalformed)
+}
+
+func TestSignInNotificationHandler(t *testing.T) {
+	srv := newTestJWKSServer(t, "kid1")
+
+	var deleted, disabled []string
+	h := &SignInNotificationHandler{
+		Keys:      NewKeySet(srv.server.URL),
+		Audiences: []string{"com.example.app"},
+		OnAccountDelete: func(r *http.Request, n *SignInNotification) error {
+			deleted = append(deleted, n.Event.Subject)
+			return nil
+		},
+		OnEmailDisabled: func(r *http.Request, n *SignInNotification) error {
+			disabled = append(disabled, n.Event.Email)
+			return errors.New("database unavailable")
+		},
+	}
+
+	serve := func(body []byte) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/apple/notifications", strings.NewReader(string(body))))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(testSignInNotificationBody(t, srv, "com.example.app", map[string]interface{}{
+		"type": "account-delete", "sub": "user-1",
+	})))
+	assert.Equal(t, []string{"user-1"}, deleted)
+
+	// A failing callback makes Apple retry.
+	assert.Equal(t, http.StatusInternalServerError, serve(testSignInNotificationBody(t, srv, "com.example.app", map[string]interface{}{
+		"type": "email-disabled", "sub": "user-2", "email": "relay@privaterelay.appleid.com",
+	})))
+	assert.Equal(t, []string{"relay@privaterelay.appleid.com"}, disabled)
+
+	// Events without a callback are acknowledged.
+	assert.Equal(t, http.StatusOK, serve(testSignInNotificationBody(t, srv, "com.example.app", map[string]interface{}{
+		"type": "consent-revoked", "sub": "user-3",
+	})))
+
+	assert.Equal(t, http.StatusBadRequest, serve([]byte(`{"payload":"forged"}`)))
+
+	// Payloads with an unknown or missing key ID are rejected, not retried.
+	claims := gojwt.MapClaims{"iss": appleAudience, "aud": "com.example.app", "events": `{"type":"account-delete","sub":"user-4"}`}
+	for _, kid := range []string{"kid9", ""} {
+		token := gojwt.NewWithClaims(gojwt.SigningMethodRS256, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		payload, err := token.SignedString(srv.keys["kid1"])
+		assert.NoError(t, err)
+		body, _ := json.Marshal(signInNotificationBody{Payload: payload})
+		assert.Equal(t, http.StatusBadRequest, serve(body))
+	}
+	assert.Equal(t, []string{"user-1"}, deleted)
+}
@@ -0,0 +1,307 @@
+package apple
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStateCookieName = "apple_auth_state"
+	defaultStateTTL        = 10 * time.Minute
+	// minStateSecretSize is the minimum size of a CookieStateStore secret.
+	minStateSecretSize = 32
+	// memorySweepInterval is how often the in-memory stores drop all their
+	// expired entries. Entries looked up in between are checked one by one.
+	memorySweepInterval = time.Minute
+)
+
+// errShortStateSecret is returned by a CookieStateStore whose secret is too
+// short to sign cookies that cannot be forged.
+var errShortStateSecret = errors.New("cookie state store secret must be at least 32 bytes")
+
+// StateStore checks the state returned to the callback against the value
+// issued with the authorization request.
+type StateStore interface {
+	// Consume validates state for the callback request r and invalidates it so
+	// it cannot be replayed. It returns the nonce bound to the state, if any.
+	Consume(r *http.Request, state string) (nonce string, err error)
+}
+
+// StateClearer is implemented by state stores that keep the state in the
+// browser, such as CookieStateStore. CallbackHandler calls Clear on every
+// callback response, whatever the outcome, so the state cannot be replayed.
+type StateClearer interface {
+	// Clear drops the state from the browser session of w.
+	Clear(w http.ResponseWriter)
+}
+
+// StateIssuer records the state and nonce of a new authorization request.
+type StateIssuer interface {
+	// Issue binds state and nonce to the browser session of w.
+	Issue(w http.ResponseWriter, state, nonce string) error
+}
+
+// GenerateState returns a cryptographically random value suitable for the
+// state parameter of an authorization request.
+func GenerateState() (string, error) {
+	return randomToken()
+}
+
+// GenerateNonce returns a cryptographically random value suitable for the
+// nonce parameter of an authorization request.
+func GenerateNonce() (string, error) {
+	return randomToken()
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthorizeURLWithState generates a random state and nonce, records them
+// with issuer and returns the authorization URL for cfg as built by
+// BuildAuthorizeURL. A State or Nonce already set in cfg is kept. Pair it
+// with a CallbackHandler using the same store, which checks the state and
+// the nonce claim of the ID token.
+func AuthorizeURLWithState(w http.ResponseWriter, issuer StateIssuer, cfg AuthorizeURLConfig) (string, error) {
+	var err error
+	if cfg.State == "" {
+		if cfg.State, err = GenerateState(); err != nil {
+			return "", err
+		}
+	}
+	if cfg.Nonce == "" {
+		if cfg.Nonce, err = GenerateNonce(); err != nil {
+			return "", err
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return "", err
+	}
+	if err := issuer.Issue(w, cfg.State, cfg.Nonce); err != nil {
+		return "", err
+	}
+	return BuildAuthorizeURL(cfg)
+}
+
+type stateEntry struct {
+	nonce     string
+	expiresAt time.Time
+}
+
+// MemoryStateStore is an in-memory StateStore for single-instance
+// deployments. A MemoryStateStore is safe for concurrent use.
+type MemoryStateStore struct {
+	// TTL is how long a saved state stays valid.
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]stateEntry
+	sweptAt time.Time
+}
+
+// NewMemoryStateStore creates a MemoryStateStore whose states expire after ttl.
+func NewMemoryStateStore(ttl time.Duration) *MemoryStateStore {
+	return &MemoryStateStore{
+		TTL:     ttl,
+		entries: make(map[string]stateEntry),
+	}
+}
+
+// Save records state and the nonce sent with the same authorization request.
+func (s *MemoryStateStore) Save(state, nonce string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.sweptAt) >= memorySweepInterval {
+		s.sweptAt = now
+		for k, e := range s.entries {
+			if now.After(e.expiresAt) {
+				delete(s.entries, k)
+			}
+		}
+	}
+	s.entries[state] = stateEntry{nonce: nonce, expiresAt: now.Add(s.TTL)}
+}
+
+// Issue implements StateIssuer.
+func (s *MemoryStateStore) Issue(_ http.ResponseWriter, state, nonce string) error {
+	s.Save(state, nonce)
+	return nil
+}
+
+// Consume implements StateStore.
+func (s *MemoryStateStore) Consume(_ *http.Request, state string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[state]
+	if !ok {
+		return "", &CallbackError{Code: CallbackErrorInvalidState, Reason: "unknown state"}
+	}
+	delete(s.entries, state)
+	if time.Now().After(e.expiresAt) {
+		return "", &CallbackError{Code: CallbackErrorInvalidState, Reason: "state expired"}
+	}
+	return e.nonce, nil
+}
+
+// CookieStateStore binds the state and nonce to the browser with a signed,
+// expiring cookie, so no server-side storage is needed. Because Apple
+// returns to the callback with a cross-site POST, the cookie is sent with
+// SameSite=None and therefore requires HTTPS.
+type CookieStateStore struct {
+	// Secret is the HMAC-SHA256 key signing the cookie. It must be at least
+	// 32 random bytes; Issue and Consume fail otherwise. Required.
+	Secret []byte
+	// Name is the cookie name. Defaults to "apple_auth_state".
+	Name string
+	// Path and Domain scope the cookie. Path defaults to "/".
+	Path   string
+	Domain string
+	// TTL is how long the cookie is valid. Defaults to 10 minutes.
+	TTL time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// NewCookieStateStore creates a CookieStateStore signing with secret.
+func NewCookieStateStore(secret []byte) *CookieStateStore {
+	return &CookieStateStore{
+		Secret: secret,
+		Name:   defaultStateCookieName,
+		Path:   "/",
+		TTL:    defaultStateTTL,
+	}
+}
+
+// stateCookie is the signed content of the state cookie.
+type stateCookie struct {
+	State     string `json:"s"`
+	Nonce     string `json:"n,omitempty"`
+	ExpiresAt int64  `json:"e"`
+}
+
+// Issue implements StateIssuer.
+func (s *CookieStateStore) Issue(w http.ResponseWriter, state, nonce string) error {
+	if len(s.Secret) < minStateSecretSize {
+		return errShortStateSecret
+	}
+
+	expiresAt := s.now().Add(s.ttl())
+	payload, err := json.Marshal(stateCookie{State: state, Nonce: nonce, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.name(),
+		Value:    encoded + "." + s.sign(encoded),
+		Path:     s.path(),
+		Domain:   s.Domain,
+		Expires:  expiresAt,
+		MaxAge:   int(s.ttl() / time.Second),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	return nil
+}
+
+// Consume implements StateStore. The cookie cannot be removed from here;
+// CallbackHandler drops it through Clear. Custom callbacks must call Clear
+// on the response themselves.
+func (s *CookieStateStore) Consume(r *http.Request, state string) (string, error) {
+	if len(s.Secret) < minStateSecretSize {
+		return "", errShortStateSecret
+	}
+
+	cookie, err := r.Cookie(s.name())
+	if err != nil {
+		return "", &CallbackError{Code: CallbackErrorInvalidState, Reason: "missing state cookie"}
+	}
+
+	encoded, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(encoded))) {
+		return "", &CallbackError{Code: CallbackErrorInvalidState, Reason: "invalid state cookie signature"}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", &CallbackError{Code: CallbackErrorInvalidState, Reason: "invalid state cookie"}
+	}
+	var c stateCookie
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return "", &CallbackError{Code: CallbackErrorInvalidState, Reason: "invalid state cookie"}
+	}
+
+	if s.now().After(time.Unix(c.ExpiresAt, 0)) {
+		return "", &CallbackError{Code: CallbackErrorInvalidState, Reason: "state expired"}
+	}
+	if subtle.ConstantTimeCompare([]byte(c.State), []byte(state)) != 1 {
+		return "", &CallbackError{Code: CallbackErrorInvalidState, Reason: "state mismatch"}
+	}
+	return c.Nonce, nil
+}
+
+// Clear implements StateClearer. It removes the state cookie.
+func (s *CookieStateStore) Clear(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.name(),
+		Value:    "",
+		Path:     s.path(),
+		Domain:   s.Domain,
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	})
+}
+
+func (s *CookieStateStore) sign(value string) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *CookieStateStore) name() string {
+	if s.Name == "" {
+		return defaultStateCookieName
+	}
+	return s.Name
+}
+
+func (s *CookieStateStore) path() string {
+	if s.Path == "" {
+		return "/"
+	}
+	return s.Path
+}
+
+func (s *CookieStateStore) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+func (s *CookieStateStore) ttl() time.Duration {
+	if s.TTL <= 0 {
+		return defaultStateTTL
+	}
+	return s.TTL
+}
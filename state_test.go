@@ -0,0 +1,155 @@
+package apple
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStateStore(t *testing.T) {
+	states := NewMemoryStateStore(time.Minute)
+	states.Save("state-1", "nonce")
+
+	nonce, err := states.Consume(nil, "state-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "nonce", nonce)
+
+	_, err = states.Consume(nil, "state-1")
+	assert.Error(t, err)
+}
+
+func TestMemoryStateStoreExpired(t *testing.T) {
+	states := NewMemoryStateStore(-time.Second)
+	states.Save("state-1", "nonce")
+
+	_, err := states.Consume(nil, "state-1")
+	var cbErr *CallbackError
+	if assert.ErrorAs(t, err, &cbErr) {
+		assert.Equal(t, CallbackErrorInvalidState, cbErr.Code)
+	}
+}
+
+func TestMemoryStateStoreSweep(t *testing.T) {
+	states := NewMemoryStateStore(-time.Second)
+	states.Save("state-1", "")
+	states.Save("state-2", "")
+	// Expired states are dropped at most once per sweep interval.
+	assert.Len(t, states.entries, 2)
+
+	states.sweptAt = time.Now().Add(-memorySweepInterval)
+	states.Save("state-3", "")
+	assert.Len(t, states.entries, 1)
+}
+
+func TestGenerateState(t *testing.T) {
+	a, err := GenerateState()
+	assert.NoError(t, err)
+	b, err := GenerateState()
+	assert.NoError(t, err)
+	assert.Len(t, a, 43)
+	assert.NotEqual(t, a, b)
+}
+
+// issueCookie runs Issue against a recorder and returns a callback request
+// carrying the resulting cookie.
+func issueCookie(t *testing.T, s *CookieStateStore, state, nonce string) *http.Request {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	assert.NoError(t, s.Issue(rec, state, nonce))
+
+	req := httptest.NewRequest("POST", "/callback", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestCookieStateStore(t *testing.T) {
+	s := NewCookieStateStore([]byte("0123456789abcdef0123456789abcdef"))
+
+	rec := httptest.NewRecorder()
+	assert.NoError(t, s.Issue(rec, "state-1", "nonce"))
+	cookies := rec.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, "apple_auth_state", cookies[0].Name)
+		assert.True(t, cookies[0].Secure)
+		assert.True(t, cookies[0].HttpOnly)
+		assert.Equal(t, http.SameSiteNoneMode, cookies[0].SameSite)
+	}
+
+	nonce, err := s.Consume(issueCookie(t, s, "state-1", "nonce"), "state-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "nonce", nonce)
+}
+
+func TestCookieStateStoreErrors(t *testing.T) {
+	s := NewCookieStateStore([]byte("0123456789abcdef0123456789abcdef"))
+	other := NewCookieStateStore([]byte("another secret of thirty-two b.."))
+	expired := NewCookieStateStore(s.Secret)
+	expired.Now = func() time.Time { return time.Now().Add(-time.Hour) }
+
+	tampered := issueCookie(t, s, "state-1", "nonce")
+	c, _ := tampered.Cookie("apple_auth_state")
+	tampered.Header.Del("Cookie")
+	tampered.AddCookie(&http.Cookie{Name: c.Name, Value: "x" + c.Value})
+
+	expiredReq := issueCookie(t, expired, "state-1", "nonce")
+
+	tests := []struct {
+		name  string
+		req   *http.Request
+		state string
+	}{
+		{"missing cookie", httptest.NewRequest("POST", "/callback", nil), "state-1"},
+		{"state mismatch", issueCookie(t, s, "state-1", "nonce"), "state-2"},
+		{"wrong secret", issueCookie(t, other, "state-1", "nonce"), "state-1"},
+		{"tampered", tampered, "state-1"},
+		{"expired", expiredReq, "state-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Consume(tt.req, tt.state)
+			var cbErr *CallbackError
+			if assert.ErrorAs(t, err, &cbErr) {
+				assert.Equal(t, CallbackErrorInvalidState, cbErr.Code)
+			}
+		})
+	}
+}
+
+func TestCookieStateStoreShortSecret(t *testing.T) {
+	valid := issueCookie(t, NewCookieStateStore([]byte("0123456789abcdef0123456789abcdef")), "state-1", "nonce")
+
+	for _, secret := range [][]byte{nil, {}, []byte("too short")} {
+		s := NewCookieStateStore(secret)
+		assert.ErrorIs(t, s.Issue(httptest.NewRecorder(), "state-1", "nonce"), errShortStateSecret)
+		_, err := s.Consume(valid, "state-1")
+		assert.ErrorIs(t, err, errShortStateSecret)
+	}
+}
+
+func TestAuthorizeURLWithState(t *testing.T) {
+	states := NewMemoryStateStore(time.Minute)
+
+	loginURL, err := AuthorizeURLWithState(nil, states, AuthorizeURLConfig{
+		ClientID:    "com.example.app",
+		RedirectURI: "https://example.com/callback",
+	})
+	assert.NoError(t, err)
+
+	u, err := url.Parse(loginURL)
+	assert.NoError(t, err)
+	state, nonce := u.Query().Get("state"), u.Query().Get("nonce")
+	assert.NotEmpty(t, state)
+	assert.NotEmpty(t, nonce)
+
+	got, err := states.Consume(nil, state)
+	assert.NoError(t, err)
+	assert.Equal(t, nonce, got)
+}
@@ -1,10 +1,13 @@
 package apple
 
 import (
+	"fmt"
 	"net/url"
 	"strings"
 )
 
+const authorizeEndpoint = "https://appleid.apple.com/auth/authorize"
+
 type ResponseMode string
 
 const (
@@ -24,6 +27,12 @@ const (
 	ResponseTypeCodeID ResponseType = "code id_token"
 )
 
+// Scopes that can be requested from Apple.
+const (
+	ScopeName  = "name"
+	ScopeEmail = "email"
+)
+
 // AuthorizeURLConfig collects every optional parameter that can be put
 // into the authorization request.
 type AuthorizeURLConfig struct {
@@ -37,28 +46,145 @@ type AuthorizeURLConfig struct {
 	Nonce        string
 	ResponseMode ResponseMode // "form_post" | "fragment"
 	ResponseType ResponseType // code or code and id_token
+
+	// Endpoint overrides Apple's authorize endpoint, e.g. with a local test
+	// server. It may use plain HTTP.
+	Endpoint string
 }
 
+// AuthorizeURL builds the authorization URL without checking cfg. An
+// Endpoint that cannot be parsed falls back to Apple's authorize endpoint.
+// Use BuildAuthorizeURL to reject invalid configurations.
 func AuthorizeURL(cfg AuthorizeURLConfig) string {
-	u, _ := url.Parse("https://appleid.apple.com/auth/authorize")
+	u, err := url.Parse(cfg.endpoint())
+	if err != nil {
+		u, _ = url.Parse(authorizeEndpoint)
+	}
+	u.RawQuery = cfg.query().Encode()
+	return u.String()
+}
+
+// BuildAuthorizeURL validates cfg and builds the authorization URL.
+func BuildAuthorizeURL(cfg AuthorizeURLConfig) (string, error) {
+	if err := cfg.Validate(); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(cfg.endpoint())
+	if err != nil {
+		return "", &AuthorizeURLError{Code: AuthorizeURLErrorInvalidEndpoint, Reason: err.Error()}
+	}
+	u.RawQuery = cfg.query().Encode()
+	return u.String(), nil
+}
+
+// Validate checks that cfg describes an authorization request Apple
+// accepts: a client ID, an absolute HTTPS redirect URI, and a supported
+// combination of response mode, response type and scopes.
+func (cfg AuthorizeURLConfig) Validate() error {
+	if cfg.ClientID == "" {
+		return &AuthorizeURLError{Code: AuthorizeURLErrorMissingClientID, Reason: "client id is required"}
+	}
+
+	redirect, err := url.Parse(cfg.RedirectURI)
+	if err != nil || redirect.Scheme != "https" || redirect.Host == "" {
+		return &AuthorizeURLError{Code: AuthorizeURLErrorInvalidRedirectURI, Reason: fmt.Sprintf("redirect uri must be an absolute https url: %q", cfg.RedirectURI)}
+	}
+	if redirect.Fragment != "" {
+		return &AuthorizeURLError{Code: AuthorizeURLErrorInvalidRedirectURI, Reason: "redirect uri must not contain a fragment"}
+	}
+
+	if cfg.Endpoint != "" {
+		endpoint, err := url.Parse(cfg.Endpoint)
+		if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" {
+			return &AuthorizeURLError{Code: AuthorizeURLErrorInvalidEndpoint, Reason: fmt.Sprintf("endpoint must be an absolute url: %q", cfg.Endpoint)}
+		}
+	}
+
+	mode := cfg.responseMode()
+	switch mode {
+	case ResponseModeQuery, ResponseModeFragment, ResponseModeFormPost:
+	default:
+		return &AuthorizeURLError{Code: AuthorizeURLErrorInvalidResponseMode, Reason: fmt.Sprintf("unsupported response mode %q", mode)}
+	}
+
+	responseType := cfg.responseType()
+	switch responseType {
+	case ResponseTypeCode, ResponseTypeCodeID:
+	default:
+		return &AuthorizeURLError{Code: AuthorizeURLErrorInvalidResponseType, Reason: fmt.Sprintf("unsupported response type %q", responseType)}
+	}
 
-	var responseMode string
+	if mode == ResponseModeQuery && responseType == ResponseTypeCodeID {
+		return &AuthorizeURLError{Code: AuthorizeURLErrorInvalidCombination, Reason: "response mode query cannot return an id_token"}
+	}
+
+	for _, scope := range cfg.Scope {
+		if scope != ScopeName && scope != ScopeEmail {
+			return &AuthorizeURLError{Code: AuthorizeURLErrorInvalidScope, Reason: fmt.Sprintf("unsupported scope %q", scope)}
+		}
+	}
+	if len(cfg.Scope) > 0 && mode != ResponseModeFormPost {
+		return &AuthorizeURLError{Code: AuthorizeURLErrorInvalidCombination, Reason: "requesting scopes requires response mode form_post"}
+	}
+
+	return nil
+}
+
+// ParseAuthorizeURL parses an authorization URL back into its config. The
+// Endpoint is only set if it differs from Apple's. The result is not
+// validated; call Validate to check it.
+func ParseAuthorizeURL(rawURL string) (AuthorizeURLConfig, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return AuthorizeURLConfig{}, &AuthorizeURLError{Code: AuthorizeURLErrorInvalidEndpoint, Reason: err.Error()}
+	}
+
+	q := u.Query()
+	cfg := AuthorizeURLConfig{
+		ClientID:     q.Get("client_id"),
+		RedirectURI:  q.Get("redirect_uri"),
+		State:        q.Get("state"),
+		Nonce:        q.Get("nonce"),
+		ResponseMode: ResponseMode(q.Get("response_mode")),
+		ResponseType: ResponseType(q.Get("response_type")),
+	}
+	if scope := q.Get("scope"); scope != "" {
+		cfg.Scope = strings.Fields(scope)
+	}
+
+	u.RawQuery = ""
+	u.Fragment = ""
+	if endpoint := u.String(); endpoint != authorizeEndpoint {
+		cfg.Endpoint = endpoint
+	}
+	return cfg, nil
+}
+
+func (cfg AuthorizeURLConfig) endpoint() string {
+	if cfg.Endpoint != "" {
+		return cfg.Endpoint
+	}
+	return authorizeEndpoint
+}
+
+func (cfg AuthorizeURLConfig) responseMode() ResponseMode {
 	if cfg.ResponseMode != "" {
-		responseMode = string(cfg.ResponseMode)
-	} else {
-		responseMode = string(ResponseModeFormPost)
+		return cfg.ResponseMode
 	}
+	return ResponseModeFormPost
+}
 
-	var responseType string
+func (cfg AuthorizeURLConfig) responseType() ResponseType {
 	if cfg.ResponseType != "" {
-		responseType = string(cfg.ResponseType)
-	} else {
-		responseType = string(ResponseTypeCodeID)
+		return cfg.ResponseType
 	}
+	return ResponseTypeCodeID
+}
 
+func (cfg AuthorizeURLConfig) query() url.Values {
 	q := url.Values{}
-	q.Add("response_type", responseType)
-	q.Add("response_mode", responseMode)
+	q.Add("response_type", string(cfg.responseType()))
+	q.Add("response_mode", string(cfg.responseMode()))
 	q.Add("client_id", cfg.ClientID)
 	q.Add("redirect_uri", cfg.RedirectURI)
 
@@ -71,7 +197,5 @@ func AuthorizeURL(cfg AuthorizeURLConfig) string {
 	if len(cfg.Scope) > 0 {
 		q.Add("scope", strings.Join(cfg.Scope, " "))
 	}
-
-	u.RawQuery = q.Encode()
-	return u.String()
+	return q
 }
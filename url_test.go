@@ -1,6 +1,7 @@
 package apple
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -61,3 +62,108 @@ func TestAuthorizeURLBugFixResponseTypeNotOverwritingResponseMode(t *testing.T)
 	// response_type should be "code id_token" (default)
 	assert.Contains(t, u, "response_type=code+id_token")
 }
+
+func TestAuthorizeURLInvalidEndpoint(t *testing.T) {
+	cfg := AuthorizeURLConfig{
+		ClientID:    "com.example.app",
+		RedirectURI: "https://example.com/callback",
+		Endpoint:    "://bad",
+	}
+
+	var u string
+	assert.NotPanics(t, func() { u = AuthorizeURL(cfg) })
+	assert.True(t, strings.HasPrefix(u, authorizeEndpoint+"?"), u)
+	assert.Contains(t, u, "client_id=com.example.app")
+}
+
+func TestBuildAuthorizeURL(t *testing.T) {
+	cfg := AuthorizeURLConfig{
+		ClientID:    "com.example.app",
+		RedirectURI: "https://example.com/callback",
+		Scope:       []string{ScopeEmail, ScopeName},
+		State:       "csrf-token",
+	}
+
+	u, err := BuildAuthorizeURL(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, AuthorizeURL(cfg), u)
+	assert.True(t, strings.HasPrefix(u, "https://appleid.apple.com/auth/authorize?"))
+}
+
+func TestBuildAuthorizeURLInvalid(t *testing.T) {
+	valid := AuthorizeURLConfig{ClientID: "com.example.app", RedirectURI: "https://example.com/callback"}
+
+	tests := []struct {
+		name   string
+		modify func(cfg *AuthorizeURLConfig)
+		code   AuthorizeURLErrorCode
+	}{
+		{"missing client id", func(cfg *AuthorizeURLConfig) { cfg.ClientID = "" }, AuthorizeURLErrorMissingClientID},
+		{"http redirect", func(cfg *AuthorizeURLConfig) { cfg.RedirectURI = "http://example.com/callback" }, AuthorizeURLErrorInvalidRedirectURI},
+		{"relative redirect", func(cfg *AuthorizeURLConfig) { cfg.RedirectURI = "/callback" }, AuthorizeURLErrorInvalidRedirectURI},
+		{"redirect fragment", func(cfg *AuthorizeURLConfig) { cfg.RedirectURI = "https://example.com/callback#x" }, AuthorizeURLErrorInvalidRedirectURI},
+		{"relative endpoint", func(cfg *AuthorizeURLConfig) { cfg.Endpoint = "/auth/authorize" }, AuthorizeURLErrorInvalidEndpoint},
+		{"unknown mode", func(cfg *AuthorizeURLConfig) { cfg.ResponseMode = "web_message" }, AuthorizeURLErrorInvalidResponseMode},
+		{"unknown type", func(cfg *AuthorizeURLConfig) { cfg.ResponseType = "token" }, AuthorizeURLErrorInvalidResponseType},
+		{"query with id token", func(cfg *AuthorizeURLConfig) { cfg.ResponseMode = ResponseModeQuery }, AuthorizeURLErrorInvalidCombination},
+		{"unknown scope", func(cfg *AuthorizeURLConfig) { cfg.Scope = []string{"openid"} }, AuthorizeURLErrorInvalidScope},
+		{"scope without form post", func(cfg *AuthorizeURLConfig) {
+			cfg.Scope = []string{ScopeEmail}
+			cfg.ResponseMode = ResponseModeFragment
+		}, AuthorizeURLErrorInvalidCombination},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.modify(&cfg)
+
+			u, err := BuildAuthorizeURL(cfg)
+			assert.Empty(t, u)
+			var urlErr *AuthorizeURLError
+			if assert.ErrorAs(t, err, &urlErr) {
+				assert.Equal(t, tt.code, urlErr.Code)
+			}
+		})
+	}
+}
+
+func TestBuildAuthorizeURLQueryWithCode(t *testing.T) {
+	_, err := BuildAuthorizeURL(AuthorizeURLConfig{
+		ClientID:     "com.example.app",
+		RedirectURI:  "https://example.com/callback",
+		ResponseMode: ResponseModeQuery,
+		ResponseType: ResponseTypeCode,
+	})
+	assert.NoError(t, err)
+}
+
+func TestParseAuthorizeURLRoundTrip(t *testing.T) {
+	tests := []AuthorizeURLConfig{
+		{
+			ClientID:     "com.example.app",
+			RedirectURI:  "https://example.com/callback?next=%2Fhome",
+			State:        "csrf-token",
+			Nonce:        "nonce-abc",
+			Scope:        []string{ScopeName, ScopeEmail},
+			ResponseMode: ResponseModeFormPost,
+			ResponseType: ResponseTypeCodeID,
+		},
+		{
+			ClientID:     "com.example.app",
+			RedirectURI:  "https://example.com/callback",
+			ResponseMode: ResponseModeQuery,
+			ResponseType: ResponseTypeCode,
+			Endpoint:     "http://127.0.0.1:8080/auth/authorize",
+		},
+	}
+
+	for _, cfg := range tests {
+		u, err := BuildAuthorizeURL(cfg)
+		assert.NoError(t, err)
+
+		parsed, err := ParseAuthorizeURL(u)
+		assert.NoError(t, err)
+		assert.Equal(t, cfg, parsed)
+	}
+}
@@ -1,6 +1,12 @@
 package apple
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/tideland/gorest/jwt"
@@ -40,18 +46,247 @@ type AppleUser struct {
 	NonceSupported *bool      `json:"nonce_supported"` // Whether nonce is supported
 	TransferSub    string     `json:"transfer_sub"`    // App transfer identifier
 	OrgID          string     `json:"org_id"`          // Organization ID (for managed accounts)
+
+	// Token binding claims, see VerifyCodeHash and VerifyAccessTokenHash.
+	CodeHash        string `json:"c_hash"`  // Hash of the authorization code
+	AccessTokenHash string `json:"at_hash"` // Hash of the access token
+
+	// Profile sent by Apple on the first authorization only, see MergeProfile.
+	Profile *AppleUserProfile `json:"profile,omitempty"`
+
+	// claims holds every claim of the token, including unknown ones.
+	claims map[string]interface{}
+}
+
+// Claims returns a copy of every claim of the ID token, including custom
+// and undocumented ones that have no field.
+func (u *AppleUser) Claims() map[string]interface{} {
+	claims := make(map[string]interface{}, len(u.claims))
+	for k, v := range u.claims {
+		claims[k] = v
+	}
+	return claims
+}
+
+// Claim returns a single raw claim of the ID token.
+func (u *AppleUser) Claim(name string) (interface{}, bool) {
+	v, ok := u.claims[name]
+	return v, ok
+}
+
+// VerifyCodeHash checks the c_hash claim against the authorization code
+// the token was issued with.
+func (u *AppleUser) VerifyCodeHash(code string) error {
+	if !tokenHashMatches(u.CodeHash, code) {
+		return &IDTokenError{Code: IDTokenErrorCodeHashMismatch, Reason: "c_hash does not match the authorization code"}
+	}
+	return nil
+}
+
+// VerifyAccessTokenHash checks the at_hash claim against the access token
+// returned with the ID token.
+func (u *AppleUser) VerifyAccessTokenHash(accessToken string) error {
+	if !tokenHashMatches(u.AccessTokenHash, accessToken) {
+		return &IDTokenError{Code: IDTokenErrorATHashMismatch, Reason: "at_hash does not match the access token"}
+	}
+	return nil
+}
+
+// tokenHashMatches reports whether claim is the OpenID Connect hash of
+// value: the left half of its SHA-256, base64url encoded, as used with RS256.
+func tokenHashMatches(claim, value string) bool {
+	if claim == "" || value == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(value))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+	return subtle.ConstantTimeCompare([]byte(strings.TrimRight(claim, "=")), []byte(expected)) == 1
+}
+
+// appleUserClaimNames lists the claims with a field in AppleUser.
+var appleUserClaimNames = []string{
+	"iss", "aud", "sub", "iat", "exp", "nonce",
+	"email", "email_verified", "is_private_email", "real_user_status",
+	"auth_time", "nonce_supported", "transfer_sub", "org_id",
+	"c_hash", "at_hash", "profile",
+}
+
+// MarshalJSON encodes the user as the ID token claims, named by the field
+// tags with times as Unix seconds. The fields are written as they are, so
+// changes to them survive a round trip, and zero fields are left out.
+// Claims without a field are kept.
+func (u AppleUser) MarshalJSON() ([]byte, error) {
+	m := u.Claims()
+	for _, name := range appleUserClaimNames {
+		// An aud claim listing several audiences has no field to live in.
+		if name == "aud" && u.Audience == "" {
+			if _, ok := m[name].([]interface{}); ok {
+				continue
+			}
+		}
+		delete(m, name)
+	}
+
+	setString := func(key, v string) {
+		if v != "" {
+			m[key] = v
+		}
+	}
+	setTime := func(key string, v time.Time) {
+		if !v.IsZero() {
+			m[key] = v.Unix()
+		}
+	}
+
+	setString("iss", u.Issuer)
+	setString("aud", u.Audience)
+	setString("sub", u.Subject)
+	setTime("iat", u.IssuedAt)
+	setTime("exp", u.Expiry)
+	setString("nonce", u.Nonce)
+	setString("email", u.Email)
+	if u.EmailVerified {
+		m["email_verified"] = true
+	}
+	if u.IsPrivateEmail {
+		m["is_private_email"] = true
+	}
+	if u.RealUserStatus != RealUserStatusUnsupported {
+		m["real_user_status"] = int(u.RealUserStatus)
+	}
+	if u.AuthTime != nil {
+		setTime("auth_time", *u.AuthTime)
+	}
+	if u.NonceSupported != nil {
+		m["nonce_supported"] = *u.NonceSupported
+	}
+	setString("transfer_sub", u.TransferSub)
+	setString("org_id", u.OrgID)
+	setString("c_hash", u.CodeHash)
+	setString("at_hash", u.AccessTokenHash)
+	if u.Profile != nil {
+		m["profile"] = u.Profile
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON decodes the output of MarshalJSON, as well as a raw ID token
+// payload. The older encoding of AppleUser, with RFC 3339 times and null
+// optional fields, is accepted too.
+func (u *AppleUser) UnmarshalJSON(data []byte) error {
+	var claims map[string]interface{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+
+	for _, name := range appleUserClaimNames {
+		if v, ok := claims[name]; ok && v == nil {
+			delete(claims, name)
+		}
+	}
+	for _, name := range []string{"iat", "exp", "auth_time"} {
+		v, ok := claims[name].(string)
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		delete(claims, name)
+		if !t.IsZero() {
+			claims[name] = float64(t.Unix())
+		}
+	}
+
+	var profile *AppleUserProfile
+	if raw, ok := claims["profile"]; ok {
+		delete(claims, "profile")
+		b, err := json.Marshal(raw)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &profile); err != nil {
+			return err
+		}
+	}
+
+	*u = *userFromClaims(claims)
+	u.Profile = profile
+	return nil
+}
+
+// AppleUserProfile is the user's name and email that Apple posts as the
+// "user" form field on the first authorization only. It is not part of the
+// signed ID token, so it must be stored when it is received.
+type AppleUserProfile struct {
+	FirstName string `json:"firstName,omitempty"`
+	LastName  string `json:"lastName,omitempty"`
+	Email     string `json:"email,omitempty"`
 }
 
-// GetUserInfoFromIDToken retrieves the user info from the JWT id token.
-// It maps every documented Apple id_token claim into the AppleUser struct.
+// appleUserPayload is the wire format of the "user" form field.
+type appleUserPayload struct {
+	Name struct {
+		FirstName string `json:"firstName"`
+		LastName  string `json:"lastName"`
+	} `json:"name"`
+	Email string `json:"email"`
+}
+
+// ParseUserProfile parses the JSON "user" form field Apple posts on the
+// first authorization. It returns nil without an error when raw is empty,
+// as it is on every later sign-in.
+func ParseUserProfile(raw string) (*AppleUserProfile, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var payload appleUserPayload
+	if err := json.Unmarshal([]byte(raw), &payload); err != nil {
+		return nil, err
+	}
+	return &AppleUserProfile{
+		FirstName: payload.Name.FirstName,
+		LastName:  payload.Name.LastName,
+		Email:     payload.Email,
+	}, nil
+}
+
+// MergeProfile attaches the first-login profile to the user verified from
+// the ID token. The profile is not signed, so its email is never copied
+// into Email; it stays in Profile.Email for the caller to decide on. The
+// returned bool reports whether the profile email differs from the token's
+// email.
+func (u *AppleUser) MergeProfile(p *AppleUserProfile) (emailMismatch bool) {
+	if p == nil {
+		return false
+	}
+	u.Profile = p
+	if p.Email == "" || u.Email == "" {
+		return false
+	}
+	return !strings.EqualFold(u.Email, p.Email)
+}
+
+// GetUserInfoFromIDToken decodes the user info from the JWT id token without
+// verifying its signature or claims, so anyone can forge the token it
+// accepts. It maps every documented Apple id_token claim into the AppleUser
+// struct.
+//
+// Deprecated: Use VerifyIDTokenWithOptions, which checks that the token was
+// signed by Apple and issued for your client.
 func GetUserInfoFromIDToken(idToken string) (*AppleUser, error) {
 	token, err := jwt.Decode(idToken)
 	if err != nil {
 		return nil, err
 	}
+	return userFromClaims(token.Claims()), nil
+}
 
-	u := AppleUser{}
-	claims := token.Claims()
+// userFromClaims maps every documented Apple id_token claim into an AppleUser.
+func userFromClaims(claims map[string]interface{}) *AppleUser {
+	u := AppleUser{claims: claims}
 
 	/* ---------- standard JWT claims ---------- */
 	if v, ok := claims["iss"].(string); ok {
@@ -118,8 +353,14 @@ func GetUserInfoFromIDToken(idToken string) (*AppleUser, error) {
 	if v, ok := claims["org_id"].(string); ok {
 		u.OrgID = v
 	}
+	if v, ok := claims["c_hash"].(string); ok {
+		u.CodeHash = v
+	}
+	if v, ok := claims["at_hash"].(string); ok {
+		u.AccessTokenHash = v
+	}
 
-	return &u, nil
+	return &u
 }
 
 /*
@@ -132,7 +373,7 @@ func parseBool(claims map[string]interface{}, key string) bool {
 	case bool:
 		return v
 	case string:
-		return v == "true"
+		return v == "true" || v == "1"
 	case float64:
 		return v != 0
 	default:
@@ -1,6 +1,7 @@
 package apple
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
 	"time"
@@ -17,6 +18,14 @@ func TestGetUserInfoFromIDToken(t *testing.T) {
 		IsPrivateEmail: false,
 		RealUserStatus: RealUserStatusLikelyReal,
 		IssuedAt:       time.Unix(1516239022, 0),
+		claims: map[string]interface{}{
+			"sub":              "1234567890",
+			"email":            "anemail@yourdomain",
+			"email_verified":   true,
+			"is_private_email": false,
+			"real_user_status": float64(2),
+			"iat":              float64(1516239022),
+		},
 	}
 
 	au, err := GetUserInfoFromIDToken(jwt)
@@ -33,3 +42,200 @@ func TestGetUserInfoFromIDToken_DecodeFail(t *testing.T) {
 	_, err := GetUserInfoFromIDToken(jwt)
 	assert.NotEqual(t, nil, err)
 }
+
+func TestParseUserProfile(t *testing.T) {
+	p, err := ParseUserProfile(`{"name":{"firstName":"Jane","lastName":"Doe"},"email":"jane@privaterelay.appleid.com"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, &AppleUserProfile{
+		FirstName: "Jane",
+		LastName:  "Doe",
+		Email:     "jane@privaterelay.appleid.com",
+	}, p)
+}
+
+func TestParseUserProfile_Empty(t *testing.T) {
+	p, err := ParseUserProfile("")
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+}
+
+func TestParseUserProfile_Invalid(t *testing.T) {
+	_, err := ParseUserProfile("{not json")
+	assert.Error(t, err)
+}
+
+func TestMergeProfile(t *testing.T) {
+	u := &AppleUser{Email: "Jane@Example.com"}
+	mismatch := u.MergeProfile(&AppleUserProfile{FirstName: "Jane", Email: "jane@example.com"})
+	assert.False(t, mismatch)
+	assert.Equal(t, "Jane", u.Profile.FirstName)
+	assert.Equal(t, "Jane@Example.com", u.Email)
+
+	u = &AppleUser{Email: "jane@privaterelay.appleid.com"}
+	mismatch = u.MergeProfile(&AppleUserProfile{Email: "jane@example.com"})
+	assert.True(t, mismatch)
+	assert.Equal(t, "jane@privaterelay.appleid.com", u.Email)
+
+	// The unsigned profile email never becomes the verified email.
+	u = &AppleUser{}
+	mismatch = u.MergeProfile(&AppleUserProfile{Email: "jane@example.com"})
+	assert.False(t, mismatch)
+	assert.Empty(t, u.Email)
+	assert.Equal(t, "jane@example.com", u.Profile.Email)
+
+	assert.False(t, u.MergeProfile(nil))
+}
+
+func TestAppleUserClaims(t *testing.T) {
+	u := userFromClaims(map[string]interface{}{
+		"sub":              "001234.abcd",
+		"is_private_email": float64(1),
+		"custom":           "value",
+	})
+	assert.True(t, u.IsPrivateEmail)
+
+	v, ok := u.Claim("custom")
+	assert.True(t, ok)
+	assert.Equal(t, "value", v)
+	_, ok = u.Claim("missing")
+	assert.False(t, ok)
+
+	// The returned map is a copy.
+	claims := u.Claims()
+	claims["custom"] = "changed"
+	v, _ = u.Claim("custom")
+	assert.Equal(t, "value", v)
+}
+
+func TestAppleUserTokenHashes(t *testing.T) {
+	// Example values from the OpenID Connect Core specification.
+	u := &AppleUser{
+		CodeHash:        "LDktKdoQak3Pk0cnXxCltA",
+		AccessTokenHash: "77QmUPtjPfzWtF2AnpK9RQ",
+	}
+	assert.NoError(t, u.VerifyCodeHash("Qcb0Orv1zh30vL1MPRsbm-diHiMwcLyZvn1arpZv-Jxf_11jnpEX3Tgfvk"))
+	assert.NoError(t, u.VerifyAccessTokenHash("jHkWEdUXMU1BwAsC4vtUsZwnNvTIxEl0z9K3vx5KF0Y"))
+
+	assertIDTokenError(t, u.VerifyCodeHash("other-code"), IDTokenErrorCodeHashMismatch)
+	assertIDTokenError(t, u.VerifyAccessTokenHash("other-token"), IDTokenErrorATHashMismatch)
+	assertIDTokenError(t, (&AppleUser{}).VerifyCodeHash("code"), IDTokenErrorCodeHashMismatch)
+}
+
+func TestAppleUserJSONRoundTrip(t *testing.T) {
+	authTime := time.Unix(1700000000, 0)
+	nonceSupported := true
+	u := &AppleUser{
+		Issuer:          "https://appleid.apple.com",
+		Audience:        "com.example.app",
+		Subject:         "001234.abcd",
+		IssuedAt:        time.Unix(1700000100, 0),
+		Expiry:          time.Unix(1700003700, 0),
+		Email:           "jane@privaterelay.appleid.com",
+		EmailVerified:   true,
+		IsPrivateEmail:  true,
+		RealUserStatus:  RealUserStatusLikelyReal,
+		AuthTime:        &authTime,
+		NonceSupported:  &nonceSupported,
+		OrgID:           "org-1",
+		AccessTokenHash: "77QmUPtjPfzWtF2AnpK9RQ",
+		Profile:         &AppleUserProfile{FirstName: "Jane"},
+		claims:          map[string]interface{}{"custom": "value"},
+	}
+
+	data, err := json.Marshal(u)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"iat":1700000100`)
+	assert.Contains(t, string(data), `"custom":"value"`)
+
+	var decoded AppleUser
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, u.Subject, decoded.Subject)
+	assert.True(t, u.IssuedAt.Equal(decoded.IssuedAt))
+	assert.True(t, u.Expiry.Equal(decoded.Expiry))
+	assert.True(t, u.AuthTime.Equal(*decoded.AuthTime))
+	assert.Equal(t, u.NonceSupported, decoded.NonceSupported)
+	assert.Equal(t, u.Email, decoded.Email)
+	assert.True(t, decoded.EmailVerified)
+	assert.True(t, decoded.IsPrivateEmail)
+	assert.Equal(t, RealUserStatusLikelyReal, decoded.RealUserStatus)
+	assert.Equal(t, u.OrgID, decoded.OrgID)
+	assert.Equal(t, u.AccessTokenHash, decoded.AccessTokenHash)
+	assert.Equal(t, u.Profile, decoded.Profile)
+	v, _ := decoded.Claim("custom")
+	assert.Equal(t, "value", v)
+
+	// Encoding again gives the same document.
+	again, err := json.Marshal(&decoded)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(data), string(again))
+}
+
+func TestAppleUserJSONRoundTripModified(t *testing.T) {
+	u := userFromClaims(map[string]interface{}{
+		"sub":            "001234.abcd",
+		"email":          "jane@example.com",
+		"email_verified": "true",
+		"org_id":         "org-1",
+		"custom":         "value",
+	})
+
+	// Fields changed after decoding the token win over the raw claims.
+	u.Email = ""
+	u.EmailVerified = false
+	u.OrgID = "org-2"
+
+	data, err := json.Marshal(u)
+	assert.NoError(t, err)
+
+	var decoded AppleUser
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, "001234.abcd", decoded.Subject)
+	assert.Empty(t, decoded.Email)
+	assert.False(t, decoded.EmailVerified)
+	assert.Equal(t, "org-2", decoded.OrgID)
+	v, _ := decoded.Claim("custom")
+	assert.Equal(t, "value", v)
+}
+
+func TestAppleUserJSONBaselineFormat(t *testing.T) {
+	// AppleUser as encoded by json.Marshal before it had MarshalJSON.
+	data := `{"iss":"https://appleid.apple.com","aud":"com.example.app","sub":"001234.abcd",` +
+		`"iat":"2023-11-14T22:13:20Z","exp":"2023-11-14T23:13:20Z","nonce":"",` +
+		`"email":"jane@privaterelay.appleid.com","email_verified":true,"is_private_email":true,"real_user_status":2,` +
+		`"auth_time":"2023-11-14T22:10:00+01:00","nonce_supported":null,"transfer_sub":"","org_id":""}`
+
+	var u AppleUser
+	assert.NoError(t, json.Unmarshal([]byte(data), &u))
+	assert.Equal(t, "001234.abcd", u.Subject)
+	assert.True(t, u.IssuedAt.Equal(time.Unix(1700000000, 0)))
+	assert.True(t, u.Expiry.Equal(time.Unix(1700003600, 0)))
+	if assert.NotNil(t, u.AuthTime) {
+		assert.True(t, u.AuthTime.Equal(time.Date(2023, 11, 14, 21, 10, 0, 0, time.UTC)))
+	}
+	assert.Nil(t, u.NonceSupported)
+	assert.True(t, u.EmailVerified)
+	assert.Equal(t, RealUserStatusLikelyReal, u.RealUserStatus)
+
+	// Zero times decode to zero values.
+	assert.NoError(t, json.Unmarshal([]byte(`{"sub":"001234.abcd","iat":"0001-01-01T00:00:00Z","auth_time":null}`), &u))
+	assert.True(t, u.IssuedAt.IsZero())
+	assert.Nil(t, u.AuthTime)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"iat":"yesterday"}`), &u))
+}
+
+func TestAppleUserJSONAudienceArray(t *testing.T) {
+	u := userFromClaims(map[string]interface{}{
+		"sub": "001234.abcd",
+		"aud": []interface{}{"com.example.app", "com.example.web"},
+	})
+
+	data, err := json.Marshal(u)
+	assert.NoError(t, err)
+
+	var decoded AppleUser
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	aud, ok := decoded.Claim("aud")
+	assert.True(t, ok)
+	assert.Equal(t, []interface{}{"com.example.app", "com.example.web"}, aud)
+}